@@ -3,21 +3,72 @@ package client
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"encoding"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
 
 	"github.com/playsthisgame/binq/types"
 )
 
+var TIMEOUT_ERROR = errors.New("timed out waiting for a response from binq")
+
+// AckError is returned by Acknowledge and Nack for what the server rejected, the
+// messages weren't delivered on this connection, were acked already or their
+// lock ran out and they may have gone to another consumer
+type AckError struct {
+	types.AckResult
+}
+
+func (e *AckError) Error() string {
+	return fmt.Sprintf("binq rejected %d messages", len(e.RejectedIds)+len(e.RejectedReceipts))
+}
+
+// features this client offers in the HELLO
+const CLIENT_FEATURES = types.FEATURE_STREAMING | types.FEATURE_COMPRESSION | types.FEATURE_HEARTBEAT
+
 type Config struct {
 	Host      string
 	Port      uint16
 	PublicKey string
+	Timeout   time.Duration // how long to wait for the server to respond, defaults to 10s
+
+	// frames with more data than the threshold are compressed with the codec,
+	// the threshold defaults to 1KiB
+	Compression       types.Codec
+	CompressThreshold int
+
+	// the server is pinged every interval, 10s by default, and the connection
+	// is dropped after MissedHeartbeats in a row go unanswered, 3 by default
+	HeartbeatInterval time.Duration
+	MissedHeartbeats  int
+
+	// every frame carries a CRC32C trailer when the server agrees, on top of
+	// whatever the transport already checks
+	Checksums bool
 }
 
 type BinqClient struct {
-	conn *types.Connection
+	conn       *types.Connection
+	timeout    time.Duration
+	requestId  atomic.Uint32
+	mutex      sync.Mutex
+	pending    map[uint32]chan *types.Response
+	streams    map[uint32]*body    // bodies being fetched, keyed by the fetch RequestId
+	deliveries []*types.TCPCommand // unbounded so a slow consumer never holds up responses
+	delivered  *sync.Cond
+	err        error // set once the connection can no longer be read from
+
+	heartbeatInterval time.Duration
+	missedHeartbeats  int
+	done              chan struct{} // closed when the readLoop stops
 }
 
 func NewBinqClient(conf *Config) (*BinqClient, error) {
@@ -51,63 +102,394 @@ func NewBinqClient(conf *Config) (*BinqClient, error) {
 
 	newConn := types.NewConnection(conn, 1)
 
-	return &BinqClient{
-		conn: &newConn,
-	}, nil
+	timeout := 10 * time.Second
+	if conf.Timeout != 0 {
+		timeout = conf.Timeout
+	}
+
+	features := CLIENT_FEATURES
+	if conf.Checksums {
+		features |= types.FEATURE_CHECKSUM
+	}
+
+	err = handshake(&newConn, features, timeout)
+	if err != nil {
+		slog.Error("handshake with binq failed", "error", err)
+		newConn.Close()
+		return nil, err
+	}
+
+	newConn.Compression = conf.Compression
+	newConn.CompressThreshold = 1024
+	if conf.CompressThreshold != 0 {
+		newConn.CompressThreshold = conf.CompressThreshold
+	}
+
+	client := &BinqClient{
+		conn:              &newConn,
+		timeout:           timeout,
+		pending:           make(map[uint32]chan *types.Response),
+		streams:           make(map[uint32]*body),
+		heartbeatInterval: 10 * time.Second,
+		missedHeartbeats:  3,
+		done:              make(chan struct{}),
+	}
+	if conf.HeartbeatInterval != 0 {
+		client.heartbeatInterval = conf.HeartbeatInterval
+	}
+	if conf.MissedHeartbeats != 0 {
+		client.missedHeartbeats = conf.MissedHeartbeats
+	}
+	client.delivered = sync.NewCond(&client.mutex)
+	go client.readLoop()
+
+	if newConn.Features.Has(types.FEATURE_HEARTBEAT) {
+		go newConn.Heartbeat(client.heartbeatInterval, client.done)
+	}
+
+	return client, nil
+}
+
+// handshake agrees on a protocol version and features with the server, it runs
+// before the readLoop so the HELLO can be read directly
+func handshake(conn *types.Connection, features types.Feature, timeout time.Duration) error {
+	hello := &types.Hello{
+		Versions: types.SUPPORTED_VERSIONS,
+		Features: features,
+	}
+	data, err := hello.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	// written in the lowest version so any server can read the header
+	err = conn.Writer.Write(&types.TCPCommand{
+		Version: types.SUPPORTED_VERSIONS[0],
+		Command: types.HELLO,
+		Data:    data,
+	})
+	if err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	cmd, err := conn.Next()
+	if err != nil {
+		return err
+	}
+
+	if cmd.Command == types.RESPONSE {
+		var res types.Response
+		err = cmd.DecodeData(&res)
+		if err != nil {
+			return err
+		}
+		return res.Err()
+	}
+	if cmd.Command != types.HELLO {
+		return fmt.Errorf("expected HELLO from server, got command %d", cmd.Command)
+	}
+
+	var res types.Hello
+	err = res.UnmarshalBinary(cmd.Data)
+	if err != nil {
+		return err
+	}
+	if len(res.Versions) != 1 || !slices.Contains(types.SUPPORTED_VERSIONS, res.Versions[0]) {
+		return fmt.Errorf("server picked an unsupported version %v", res.Versions)
+	}
+
+	conn.Version = res.Versions[0]
+	conn.Features = res.Features
+	return nil
+}
+
+// readLoop hands responses to the request waiting on them and everything else
+// to the consumer
+func (c *BinqClient) readLoop() {
+	defer close(c.done)
+
+	for {
+		if c.conn.Features.Has(types.FEATURE_HEARTBEAT) {
+			c.conn.SetReadDeadline(time.Now().Add(c.heartbeatInterval * time.Duration(c.missedHeartbeats)))
+		}
+
+		cmd, err := c.conn.Next()
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				err = fmt.Errorf("binq missed %d heartbeats: %w", c.missedHeartbeats, err)
+			}
+			c.fail(err)
+			return
+		}
+
+		switch cmd.Command {
+		case types.PING:
+			err = c.conn.Pong(cmd)
+			if err != nil {
+				slog.Debug("Error answering ping", "error", err)
+			}
+			continue
+		case types.PONG:
+			// reading it was enough to push the deadline back
+			continue
+		case types.CHUNK, types.CHUNK_END:
+			c.readChunk(cmd)
+			continue
+		}
+
+		if cmd.Command != types.RESPONSE {
+			c.mutex.Lock()
+			c.deliveries = append(c.deliveries, cmd)
+			c.delivered.Signal()
+			c.mutex.Unlock()
+			continue
+		}
+
+		var res types.Response
+		err = cmd.DecodeData(&res)
+		if err != nil {
+			slog.Error("Error unmarshalling response", "requestId", cmd.RequestId, "error", err)
+			continue
+		}
+
+		// the server is about to drop the connection
+		if res.Status == types.STATUS_PROTOCOL_ERROR {
+			c.fail(fmt.Errorf("%w: %w", types.PROTOCOL_ERROR, res.Err()))
+			return
+		}
+
+		c.mutex.Lock()
+		ch, ok := c.pending[cmd.RequestId]
+		delete(c.pending, cmd.RequestId)
+		c.mutex.Unlock()
+
+		if ok {
+			ch <- &res
+		}
+	}
+}
+
+// fail stops everything waiting on the connection with err
+func (c *BinqClient) fail(err error) {
+	// nothing more can be read, make sure nothing more is written either
+	c.conn.Close()
+
+	c.mutex.Lock()
+	c.err = err
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+	for id, stream := range c.streams {
+		stream.end(err)
+		delete(c.streams, id)
+	}
+	c.delivered.Broadcast()
+	c.mutex.Unlock()
 }
 
 func (c *BinqClient) Close() {
 	c.conn.Close()
 }
 
-// create a queue
+// create a queue, creating one that already exists with the same partitions
+// does nothing
 func (c *BinqClient) Create(queue types.Queue) error {
-	data, err := queue.MarshalBinary()
+	cmd, err := c.newCommand(types.CREATE, &queue)
 	if err != nil {
 		return err
 	}
 
-	cmd := &types.TCPCommand{
-		Command: 1,
-		Data:    []byte(data),
+	_, err = sendCommand(c, cmd)
+	return err
+}
+
+// Alter changes the partitions of a queue, they can only be increased. The
+// consumers of the queue are rebalanced onto the new partitions
+func (c *BinqClient) Alter(queue types.Queue) error {
+	cmd, err := c.newCommand(types.ALTER, &queue)
+	if err != nil {
+		return err
 	}
 
-	return sendCommand(c, cmd)
+	_, err = sendCommand(c, cmd)
+	return err
 }
 
-// publish message
-func (c *BinqClient) Publish(message types.Message) error {
-	data, err := message.MarshalBinary()
+// Redrive moves messages from a dead-letter queue back to the queues they came
+// from and returns how many were moved
+func (c *BinqClient) Redrive(redrive types.Redrive) (int, error) {
+	cmd, err := c.newCommand(types.REDRIVE, &redrive)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	cmd := &types.TCPCommand{
-		Command: 2,
-		Data:    data,
+	res, err := sendCommand(c, cmd)
+	if err != nil {
+		return 0, err
+	}
+
+	var result types.RedriveResult
+	err = res.Decode(&result)
+	return result.Count, err
+}
+
+// publish message, returns the id of the message once it has been stored. A
+// message with the MessageKey of one published shortly before isn't stored,
+// the id of the first one is returned instead
+func (c *BinqClient) Publish(message types.Message) (uint, error) {
+	cmd, err := c.newCommand(types.PUBLISH, &message)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := sendCommand(c, cmd)
+	if err != nil {
+		return 0, err
+	}
+
+	var result types.PublishResult
+	err = res.Decode(&result)
+	return result.MessageId, err
+}
+
+// PublishBatch publishes many messages at once, they can go to different
+// queues and are stored together. It returns a result for every message in the
+// same order, the messages that couldn't be stored have an error in theirs
+func (c *BinqClient) PublishBatch(messages []types.Message) ([]types.PublishResult, error) {
+	cmd, err := c.newCommand(types.PUBLISH_BATCH, &types.MessageBatch{Messages: messages})
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := sendCommand(c, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	var result types.PublishBatchResult
+	err = res.Decode(&result)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Results) != len(messages) {
+		return nil, fmt.Errorf("binq returned %d results for %d messages", len(result.Results), len(messages))
+	}
+	return result.Results, nil
+}
+
+// NewMessageKey returns a random MessageKey, set it on a message before it is
+// first published and publishing it again after a timeout can't store it twice
+func NewMessageKey() string {
+	return uuid.NewString()
+}
+
+// Send sends a custom command registered on the server and waits for its
+// response, the result of the command is read from it with Response.Decode
+func (c *BinqClient) Send(op types.Opcode, payload encoding.BinaryMarshaler) (*types.Response, error) {
+	cmd, err := c.newCommand(op, payload)
+	if err != nil {
+		return nil, err
 	}
 
 	return sendCommand(c, cmd)
 }
 
-func sendCommand(c *BinqClient, cmd *types.TCPCommand) error {
-	data, err := cmd.MarshalBinary()
+// newCommand encodes the payload in the version agreed with the server
+func (c *BinqClient) newCommand(command types.Opcode, payload encoding.BinaryMarshaler) (*types.TCPCommand, error) {
+	cmd := c.conn.NewCommand(command, 0)
+	err := cmd.EncodeData(payload)
 	if err != nil {
-		slog.Error("Error marshalling data:", "error", err)
-		return err
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// sendCommand writes the command and blocks until the server responds or the
+// timeout expires
+func sendCommand(c *BinqClient, cmd *types.TCPCommand) (*types.Response, error) {
+	ch, err := c.register(cmd)
+	if err != nil {
+		return nil, err
 	}
 
-	_, err = c.conn.Writer.Writer.Write(data)
+	err = c.conn.Write(cmd)
 	if err != nil {
 		slog.Error("Error writing to server", "error", err)
-		return err
+		c.forget(cmd.RequestId)
+		return nil, err
+	}
+
+	return c.await(cmd.RequestId, ch)
+}
+
+// register gives the command a RequestId and returns the channel its response
+// will be delivered on
+func (c *BinqClient) register(cmd *types.TCPCommand) (chan *types.Response, error) {
+	cmd.RequestId = c.requestId.Add(1)
+	ch := make(chan *types.Response, 1)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.err != nil {
+		return nil, c.err
+	}
+	c.pending[cmd.RequestId] = ch
+	return ch, nil
+}
+
+// await blocks until the response for requestId arrives or the timeout expires
+func (c *BinqClient) await(requestId uint32, ch chan *types.Response) (*types.Response, error) {
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+
+	select {
+	case res, ok := <-ch:
+		if !ok {
+			return nil, fmt.Errorf("connection lost before response: %w", c.err)
+		}
+		return res, res.Err()
+	case <-timer.C:
+		c.forget(requestId)
+		return nil, TIMEOUT_ERROR
 	}
-	return nil
+}
+
+// nextDelivery blocks until the server has pushed something that isn't a response
+func (c *BinqClient) nextDelivery() (*types.TCPCommand, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for len(c.deliveries) == 0 && c.err == nil {
+		c.delivered.Wait()
+	}
+	if len(c.deliveries) == 0 {
+		return nil, c.err
+	}
+
+	cmd := c.deliveries[0]
+	if cmd.Command == types.GOAWAY {
+		// left in place so every later receive stops too
+		return nil, types.SHUTDOWN_ERROR
+	}
+	c.deliveries[0] = nil
+	c.deliveries = c.deliveries[1:]
+	return cmd, nil
+}
+
+func (c *BinqClient) forget(requestId uint32) {
+	c.mutex.Lock()
+	delete(c.pending, requestId)
+	c.mutex.Unlock()
 }
 
 type BinqConsumerClient struct {
 	binqClient      *BinqClient
 	consumerRequest *types.ConsumerRequest
+	revoked         []int // answered with REVOKED by the next Receive
 }
 
 func NewBinqConsumerClient(
@@ -115,16 +497,12 @@ func NewBinqConsumerClient(
 	consumerRequest *types.ConsumerRequest,
 ) (*BinqConsumerClient, error) {
 	// establish connection as consumer client
-	req, err := consumerRequest.MarshalBinary()
+	cmd, err := binqClient.newCommand(types.RECEIVE, consumerRequest)
 	if err != nil {
 		return nil, err
 	}
 
-	cmd := &types.TCPCommand{
-		Command: 3,
-		Data:    req,
-	}
-	err = sendCommand(binqClient, cmd)
+	_, err = sendCommand(binqClient, cmd)
 	if err != nil {
 		return nil, err
 	}
@@ -135,41 +513,110 @@ func NewBinqConsumerClient(
 	}, nil
 }
 
-// receive messages
+// receive messages, a batch with Revoked set means the consumer is losing
+// those partitions. Receiving again tells the server the consumer is done with
+// what it had from them and they can go to another consumer
 func (c *BinqConsumerClient) Receive() (*types.MessageBatch, error) {
-	cmd, err := c.binqClient.conn.Next()
+	if len(c.revoked) > 0 {
+		cmd, err := c.binqClient.newCommand(types.REVOKED, &types.Revocation{Partitions: c.revoked})
+		if err != nil {
+			return nil, err
+		}
+		_, err = sendCommand(c.binqClient, cmd)
+		if err != nil {
+			return nil, err
+		}
+		c.revoked = nil
+	}
+
+	cmd, err := c.binqClient.nextDelivery()
 	if err != nil {
 		slog.Error("Error receiving messages", "error", err)
 		return nil, err
 	}
 
+	if cmd.Command == types.REVOKE {
+		var revocation types.Revocation
+		err = cmd.DecodeData(&revocation)
+		if err != nil {
+			return nil, err
+		}
+		c.revoked = revocation.Partitions
+		return &types.MessageBatch{Revoked: revocation.Partitions}, nil
+	}
+
 	var msgBatch types.MessageBatch
-	err = msgBatch.UnmarshalBinary(cmd.Data)
+	err = cmd.DecodeData(&msgBatch)
 	if err != nil {
 		return nil, err
 	}
 
+	// bodies the server stored compressed
+	for i := range msgBatch.Messages {
+		err = msgBatch.Messages[i].Decompress()
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return &msgBatch, nil
 }
 
+// Acknowledge acks messages by their Receipt, an *AckError lists the
+// ones the server rejected, the others were acked
 func (c *BinqConsumerClient) Acknowledge(ackMessages *types.AckMessages) error {
-	data, err := ackMessages.MarshalBinary()
+	cmd, err := c.binqClient.newCommand(types.ACK, ackMessages)
 	if err != nil {
 		return err
 	}
 
-	cmd := &types.TCPCommand{
-		Command: 4,
-		Data:    data,
+	res, err := sendCommand(c.binqClient, cmd)
+	if err != nil {
+		return err
 	}
+	return rejected(res)
+}
 
-	err = sendCommand(c.binqClient, cmd)
+// rejected reads the AckResult of an ACK or NACK
+func rejected(res *types.Response) error {
+	var result types.AckResult
+	err := res.Decode(&result)
 	if err != nil {
 		return err
 	}
+	if len(result.RejectedIds) > 0 || len(result.RejectedReceipts) > 0 {
+		return &AckError{AckResult: result}
+	}
 	return nil
 }
 
+// Nack hands messages back by their Receipt, they are delivered again
+// once the Delay is over. An *AckError lists the ones the server rejected
+func (c *BinqConsumerClient) Nack(nack *types.NackMessages) error {
+	cmd, err := c.binqClient.newCommand(types.NACK, nack)
+	if err != nil {
+		return err
+	}
+
+	res, err := sendCommand(c.binqClient, cmd)
+	if err != nil {
+		return err
+	}
+	return rejected(res)
+}
+
+// Grant lets the server send credit more messages, for consumers that asked
+// for ManualCredit
+func (c *BinqConsumerClient) Grant(credit int) error {
+	cmd, err := c.binqClient.newCommand(types.CREDIT, &types.Credit{Count: credit})
+	if err != nil {
+		return err
+	}
+
+	_, err = sendCommand(c.binqClient, cmd)
+	return err
+}
+
 func (c *BinqConsumerClient) Stop() {
 	c.Stop()
 }
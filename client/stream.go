@@ -0,0 +1,283 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+
+	"github.com/playsthisgame/binq/types"
+)
+
+var STREAMING_ERROR = errors.New("binq server does not support streaming")
+
+// how many chunks of a fetched body the server sends ahead of the reader
+const fetchWindow = 8
+
+// PublishStream publishes a message whose body is read from body, the body is
+// sent in chunks so it never has to fit in memory. Any Data on the message is
+// sent ahead of the body. It returns the id of the message, or of the one
+// published first with the same MessageKey
+func (c *BinqClient) PublishStream(message types.Message, body io.Reader) (uint, error) {
+	if !c.conn.Features.Has(types.FEATURE_STREAMING) {
+		return 0, STREAMING_ERROR
+	}
+
+	cmd, err := c.newCommand(types.PUBLISH_STREAM, &message)
+	if err != nil {
+		return 0, err
+	}
+	ch, err := c.register(cmd)
+	if err != nil {
+		return 0, err
+	}
+
+	err = c.conn.Write(cmd)
+	if err != nil {
+		slog.Error("Error writing to server", "error", err)
+		c.forget(cmd.RequestId)
+		return 0, err
+	}
+
+	buf := make([]byte, types.STREAM_CHUNK_SIZE)
+	for {
+		// the server only answers early when it has given up on the stream
+		select {
+		case res, ok := <-ch:
+			if !ok {
+				return 0, c.err
+			}
+			return 0, res.Err()
+		default:
+		}
+
+		n, readErr := io.ReadFull(body, buf)
+		if n > 0 {
+			chunk := c.conn.NewCommand(types.CHUNK, cmd.RequestId)
+			chunk.Data = buf[:n]
+			err = c.conn.Write(chunk)
+			if err != nil {
+				slog.Error("Error writing to server", "error", err)
+				c.forget(cmd.RequestId)
+				return 0, err
+			}
+		}
+
+		if errors.Is(readErr, io.EOF) || errors.Is(readErr, io.ErrUnexpectedEOF) {
+			break
+		}
+		if readErr != nil {
+			// tell the server to throw away what it has so far
+			c.endStream(cmd.RequestId, readErr)
+			c.forget(cmd.RequestId)
+			return 0, readErr
+		}
+	}
+
+	err = c.endStream(cmd.RequestId, nil)
+	if err != nil {
+		c.forget(cmd.RequestId)
+		return 0, err
+	}
+
+	res, err := c.await(cmd.RequestId, ch)
+	if err != nil {
+		return 0, err
+	}
+
+	var result types.PublishResult
+	err = res.Decode(&result)
+	return result.MessageId, err
+}
+
+func (c *BinqClient) endStream(requestId uint32, streamErr error) error {
+	end := c.conn.NewCommand(types.CHUNK_END, requestId)
+	err := end.EncodeData(types.NewResponse(streamErr))
+	if err != nil {
+		return err
+	}
+	return c.conn.Write(end)
+}
+
+// Open returns the body of a message, streamed bodies are fetched from the
+// server in chunks. The server only sends a few chunks ahead of the reader, the
+// body should be read to the end or closed.
+func (c *BinqConsumerClient) Open(message *types.Message) (io.ReadCloser, error) {
+	if !message.Streamed {
+		return io.NopCloser(bytes.NewReader(message.Data)), nil
+	}
+
+	if !c.binqClient.conn.Features.Has(types.FEATURE_STREAMING) {
+		return nil, STREAMING_ERROR
+	}
+
+	cmd, err := c.binqClient.newCommand(types.FETCH, &types.FetchRequest{MessageId: message.ID, Receipt: message.Receipt, Window: fetchWindow})
+	if err != nil {
+		return nil, err
+	}
+	ch, err := c.binqClient.register(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := newBody(
+		func() { c.binqClient.creditFetch(cmd.RequestId) },
+		func() {
+			c.binqClient.dropStream(cmd.RequestId, io.ErrClosedPipe)
+			c.binqClient.endStream(cmd.RequestId, io.ErrClosedPipe)
+		},
+	)
+	c.binqClient.mutex.Lock()
+	c.binqClient.streams[cmd.RequestId] = reader
+	c.binqClient.mutex.Unlock()
+
+	err = c.binqClient.conn.Write(cmd)
+	if err == nil {
+		_, err = c.binqClient.await(cmd.RequestId, ch)
+	}
+	if err != nil {
+		c.binqClient.forget(cmd.RequestId)
+		c.binqClient.dropStream(cmd.RequestId, err)
+		return nil, err
+	}
+
+	return reader, nil
+}
+
+// readChunk hands a chunk of a fetched body to whoever is reading it, it never
+// waits on the reader so the read loop is never held up
+func (c *BinqClient) readChunk(cmd *types.TCPCommand) {
+	c.mutex.Lock()
+	stream, ok := c.streams[cmd.RequestId]
+	c.mutex.Unlock()
+	if !ok {
+		return
+	}
+
+	if cmd.Command == types.CHUNK {
+		stream.write(cmd.Data)
+		return
+	}
+
+	var res types.Response
+	err := cmd.DecodeData(&res)
+	if err == nil {
+		err = res.Err()
+	}
+	c.dropStream(cmd.RequestId, err)
+}
+
+// creditFetch lets the server send another chunk of a fetched body
+func (c *BinqClient) creditFetch(requestId uint32) {
+	cmd := c.conn.NewCommand(types.FETCH_CREDIT, requestId)
+	err := cmd.EncodeData(&types.Credit{Count: 1})
+	if err == nil {
+		err = c.conn.Write(cmd)
+	}
+	if err != nil {
+		slog.Debug("Error crediting fetch", "requestId", requestId, "error", err)
+	}
+}
+
+func (c *BinqClient) dropStream(requestId uint32, err error) {
+	c.mutex.Lock()
+	stream, ok := c.streams[requestId]
+	delete(c.streams, requestId)
+	c.mutex.Unlock()
+
+	if ok {
+		stream.end(err)
+	}
+}
+
+// body is a fetched body, the chunks are queued as they arrive so a slow reader
+// never holds up the connection. The server sends no more than the window
+// ahead, every chunk that was read lets it send another
+type body struct {
+	mutex   sync.Mutex
+	arrived *sync.Cond
+	chunks  [][]byte
+	err     error // io.EOF once the last chunk arrived
+	closed  bool
+	onRead  func() // a chunk was read in full
+	onClose func() // closed before the body ended
+}
+
+func newBody(onRead func(), onClose func()) *body {
+	b := &body{onRead: onRead, onClose: onClose}
+	b.arrived = sync.NewCond(&b.mutex)
+	return b
+}
+
+func (b *body) write(chunk []byte) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// the reader was closed early, the rest of the body is dropped
+	if b.closed || b.err != nil {
+		return
+	}
+	b.chunks = append(b.chunks, chunk)
+	b.arrived.Signal()
+}
+
+// end stops the body once the queued chunks are read, a nil err is a body that
+// was sent in full
+func (b *body) end(err error) {
+	if err == nil {
+		err = io.EOF
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.err == nil {
+		b.err = err
+	}
+	b.arrived.Broadcast()
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	b.mutex.Lock()
+	for len(b.chunks) == 0 && b.err == nil && !b.closed {
+		b.arrived.Wait()
+	}
+	if b.closed {
+		b.mutex.Unlock()
+		return 0, io.ErrClosedPipe
+	}
+	if len(b.chunks) == 0 {
+		b.mutex.Unlock()
+		return 0, b.err
+	}
+
+	n := copy(p, b.chunks[0])
+	b.chunks[0] = b.chunks[0][n:]
+	read := len(b.chunks[0]) == 0
+	if read {
+		b.chunks[0] = nil
+		b.chunks = b.chunks[1:]
+	}
+	ended := b.err != nil
+	b.mutex.Unlock()
+
+	// the rest of the body is on its way already once it ended
+	if read && !ended {
+		b.onRead()
+	}
+	return n, nil
+}
+
+func (b *body) Close() error {
+	b.mutex.Lock()
+	stop := !b.closed && b.err == nil
+	b.closed = true
+	b.chunks = nil
+	b.arrived.Broadcast()
+	b.mutex.Unlock()
+
+	if stop {
+		b.onClose()
+	}
+	return nil
+}
@@ -29,21 +29,15 @@ func main() {
 	fileName := filepath.Base(path)
 	fileExtension := filepath.Ext(path)
 
-	data, err := imageToBytes(path)
-	if err != nil {
-		logger.Info("Error getting []byte from image", "path", path)
-		os.Exit(1)
-	}
-
-	binq_client.Publish(types.Message{
+	// stream the file so it never has to be read into memory
+	id, err := binq_client.PublishStream(types.Message{
 		QueueName:     queueName,
 		FileExtension: fileExtension,
 		FileName:      fileName,
-		Data:          data,
-	})
-}
-
-func imageToBytes(filePath string) ([]byte, error) {
-	// Read the entire file into memory
-	return os.ReadFile(filePath)
+	}, file)
+	if err != nil {
+		logger.Error("Error publishing image", "path", path, "error", err)
+		os.Exit(1)
+	}
+	logger.Info("Published image", "path", path, "id", id)
 }
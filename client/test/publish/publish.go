@@ -25,12 +25,28 @@ func main() {
 	// 	MaxPartitions: 100,
 	// })
 
-	// send 100 message to a queue
+	// send 10000 messages to a queue, 500 at a time
 
+	batch := make([]types.Message, 0, 500)
 	for i := range make([]struct{}, 10000) {
-		client.Publish(types.Message{
+		batch = append(batch, types.Message{
 			QueueName: queueName,
 			Data:      []byte(fmt.Sprintf("this is a message thats sent to binq %v", i)),
 		})
+		if len(batch) < cap(batch) {
+			continue
+		}
+
+		results, err := client.PublishBatch(batch)
+		if err != nil {
+			slog.Error("Error publishing batch", "error", err)
+			return
+		}
+		for _, result := range results {
+			if err := result.Err(); err != nil {
+				slog.Error("Error publishing message", "error", err)
+			}
+		}
+		batch = batch[:0]
 	}
 }
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
 	"image"
 	"image/jpeg"
@@ -33,13 +32,21 @@ func main() {
 			slog.Error("error receiving messages", "queueName", queueName)
 		}
 
-		ids := make([]uint, len(msgs.Messages))
+		receipts := make([]string, len(msgs.Messages))
 		for i, msg := range msgs.Messages {
-			ids[i] = msg.ID
+			receipts[i] = msg.Receipt
 
-			img, format, err := byteSliceToImage(msg.Data)
+			body, err := consumer.Open(&msg)
+			if err != nil {
+				slog.Error("Failed to open image", "Error", err)
+				continue
+			}
+
+			img, format, err := image.Decode(body)
+			body.Close()
 			if err != nil {
 				slog.Error("Failed to decode image", "Error", err)
+				continue
 			}
 
 			slog.Info("Successfully decoded image, dimensions:", "format",
@@ -56,27 +63,14 @@ func main() {
 
 		}
 
-		if len(ids) > 0 {
+		if len(receipts) > 0 {
 			consumer.Acknowledge(&types.AckMessages{
-				MessageIds: ids,
+				Receipts: receipts,
 			})
 		}
 	}
 }
 
-func byteSliceToImage(data []byte) (image.Image, string, error) {
-	// Create a reader from the byte slice
-	reader := bytes.NewReader(data)
-
-	// Decode the image
-	img, format, err := image.Decode(reader)
-	if err != nil {
-		return nil, "", err
-	}
-
-	return img, format, nil
-}
-
 func saveImage(img image.Image, format, filePath string) error {
 	// Create a new file
 	file, err := os.Create(filePath)
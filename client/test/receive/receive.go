@@ -31,15 +31,15 @@ func main() {
 		}
 
 		// ack messages
-		ids := make([]uint, len(msgs.Messages))
+		receipts := make([]string, len(msgs.Messages))
 		for i, msg := range msgs.Messages {
-			ids[i] = msg.ID
+			receipts[i] = msg.Receipt
 			slog.Info("messages received", "message", string(msg.Data), "id", msg.ID)
 		}
 
-		if len(ids) > 0 {
+		if len(receipts) > 0 {
 			consumerClient.Acknowledge(&types.AckMessages{
-				MessageIds: ids,
+				Receipts: receipts,
 			})
 		}
 	}
@@ -5,6 +5,7 @@ go 1.22.2
 require (
 	github.com/glebarez/sqlite v1.11.0
 	github.com/google/uuid v1.6.0
+	github.com/klauspost/compress v1.17.11
 	gorm.io/gorm v1.25.12
 )
 
@@ -0,0 +1,318 @@
+package handler
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/playsthisgame/binq/store"
+	"github.com/playsthisgame/binq/types"
+	"github.com/playsthisgame/binq/utils"
+)
+
+// deadLetters runs deadLetter for every group with messages it ran out of
+// deliveries for. They aren't claimed again in the meantime
+func (h *CommandHandler) deadLetters() {
+	var groups []struct {
+		QueueName string
+		GroupName string
+	}
+	res := h.db.Raw(
+		`SELECT DISTINCT deliveries.queue_name, deliveries.group_name FROM deliveries
+		JOIN queues ON queues.name = deliveries.queue_name AND queues.deleted_at IS NULL
+		WHERE queues.max_deliveries > 0 AND NOT deliveries.acked AND deliveries.attempts >= queues.max_deliveries
+		AND (deliveries.lock_date_time IS NULL OR deliveries.lock_date_time <= ?)`,
+		time.Now(),
+	).Scan(&groups)
+	if res.Error != nil {
+		slog.Error("Error looking for messages out of deliveries", "error", res.Error)
+		return
+	}
+
+	for _, group := range groups {
+		queue, err := h.queues.get(group.QueueName)
+		if err != nil {
+			slog.Error("Error dead-lettering messages", "queue", group.QueueName, "group", group.GroupName, "error", err)
+			continue
+		}
+
+		deadLetterQueue, err := deadLetter(queue, group.GroupName, h.queues, h.db)
+		if err != nil {
+			slog.Error("Error dead-lettering messages", "queue", group.QueueName, "group", group.GroupName, "error", err)
+		}
+		if deadLetterQueue != "" {
+			h.published.notify(deadLetterQueue)
+		}
+	}
+}
+
+// deadLetter gives up on the messages the group was sent MaxDeliveries times
+// without acking them. They are copied to the dead-letter queue of the queue
+// along with what happened to them, and acked for the group. It returns the
+// dead-letter queue when anything was copied to it
+func deadLetter(queue *types.Queue, group string, queues *queues, db *gorm.DB) (string, error) {
+	if queue.MaxDeliveries <= 0 {
+		return "", nil
+	}
+
+	deadLetterQueue, err := deadLetterQueueOf(queue.DeadLetterQueue, queues)
+	if err != nil {
+		return "", err
+	}
+
+	moved, err := moveToDeadLetters(deadLetterQueue, db, func(tx *gorm.DB, letter letterFunc) error {
+		// whoever takes the deliveries deals with them, any consumer of the group can
+		var dead []types.Delivery
+		res := tx.Raw(
+			`UPDATE deliveries SET acked = true, connection = 0
+			WHERE queue_name = ? AND group_name = ? AND NOT acked AND attempts >= ? AND (lock_date_time IS NULL OR lock_date_time <= ?)
+			RETURNING message_id, attempts, history`,
+			queue.Name,
+			group,
+			queue.MaxDeliveries,
+			time.Now(),
+		).Scan(&dead)
+		if res.Error != nil {
+			return res.Error
+		}
+		if len(dead) == 0 {
+			return nil
+		}
+
+		ids := make([]uint, len(dead))
+		for i, delivery := range dead {
+			ids[i] = delivery.MessageID
+		}
+
+		if deadLetterQueue == nil {
+			slog.Warn("dropping messages that ran out of deliveries", "queue", queue.Name, "group", group, "ids", ids)
+			return removeAcked(ids, tx)
+		}
+
+		var msgs []types.Message
+		res = tx.Find(&msgs, ids)
+		if res.Error != nil {
+			return res.Error
+		}
+
+		for _, delivery := range dead {
+			i := slices.IndexFunc(msgs, func(msg types.Message) bool { return msg.ID == delivery.MessageID })
+			if i < 0 {
+				continue
+			}
+			msg := msgs[i]
+
+			reason := fmt.Sprintf("delivered %d times without an ack", delivery.Attempts)
+			if n := len(delivery.History); n > 0 && delivery.History[n-1].Reason != "" {
+				reason = fmt.Sprintf("%s, last handed back with: %s", reason, delivery.History[n-1].Reason)
+			}
+
+			err := letter(&msg, &types.DeadLetter{
+				QueueName: queue.Name,
+				Group:     group,
+				MessageID: msg.ID,
+				Reason:    reason,
+				Attempts:  delivery.History,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return removeAcked(ids, tx)
+	})
+	if err != nil {
+		return "", fmt.Errorf("error dead-lettering messages of %s: %w", queue.Name, err)
+	}
+
+	if moved == 0 {
+		return "", nil
+	}
+	slog.Info("Messages Dead-Lettered", "queue", queue.Name, "group", group, "dead-letter queue", queue.DeadLetterQueue, "count", moved)
+	return queue.DeadLetterQueue, nil
+}
+
+// deadLetterQueueOf looks up a dead-letter queue before the transaction moving
+// messages to it, creating it can't wait on that. It is nil without a name
+func deadLetterQueueOf(name string, queues *queues) (*types.Queue, error) {
+	if name == "" {
+		return nil, nil
+	}
+	return queues.get(name)
+}
+
+// letterFunc copies a message to the dead-letter queue with what happened to it
+type letterFunc func(msg *types.Message, deadLetter *types.DeadLetter) error
+
+// moveToDeadLetters runs move in a transaction, the messages it gives up on are
+// copied to the dead-letter queue with the letterFunc it is passed. The blobs
+// copied for streamed messages are removed again when the transaction fails.
+// It returns how many messages were copied
+func moveToDeadLetters(deadLetterQueue *types.Queue, db *gorm.DB, move func(tx *gorm.DB, letter letterFunc) error) (int, error) {
+	var copied []string // blobs to remove when the copies aren't stored
+	moved := 0
+	err := db.Transaction(func(tx *gorm.DB) error {
+		return move(tx, func(msg *types.Message, deadLetter *types.DeadLetter) error {
+			letter, err := letterFor(msg, deadLetterQueue, deadLetter)
+			if err != nil {
+				return err
+			}
+			if letter.BlobName != "" {
+				copied = append(copied, letter.BlobName)
+			}
+
+			res := tx.Create(letter)
+			if res.Error != nil {
+				return res.Error
+			}
+			moved++
+			return nil
+		})
+	})
+	if err != nil {
+		for _, name := range copied {
+			store.RemoveBlob(name)
+		}
+		return 0, err
+	}
+	return moved, nil
+}
+
+// letterFor copies a message for the dead-letter queue, the body of a streamed
+// message is copied to a blob of its own
+func letterFor(msg *types.Message, deadLetterQueue *types.Queue, deadLetter *types.DeadLetter) (*types.Message, error) {
+	letter := &types.Message{
+		QueueName:     deadLetterQueue.Name,
+		PartitionKey:  msg.PartitionKey,
+		Priority:      msg.Priority,
+		Headers:       msg.Headers,
+		FileExtension: msg.FileExtension,
+		FileName:      msg.FileName,
+		Streamed:      msg.Streamed,
+		Size:          msg.Size,
+		Compression:   msg.Compression,
+		Data:          msg.Data,
+		DeadLetter:    deadLetter,
+	}
+	assignPartition(letter, deadLetterQueue)
+
+	// it lasts as long as the dead-letter queue keeps messages
+	err := expireMessage(letter, deadLetterQueue)
+	if err != nil {
+		return nil, err
+	}
+
+	if msg.Streamed {
+		letter.BlobName, err = store.CopyBlob(msg.BlobName)
+		if err != nil {
+			return nil, fmt.Errorf("error copying blob of message %d: %w", msg.ID, err)
+		}
+	}
+	return letter, nil
+}
+
+// redrive moves dead-lettered messages back to the queues they came from. The
+// other groups of the queue already acked them, only the group that gave up
+// on them gets them again. Expired messages go to every group, without expiring
+func redrive(cmd *types.TCPCommand, queues *queues, db *gorm.DB) (*types.RedriveResult, []string, error) {
+	var req types.Redrive
+	err := cmd.DecodeData(&req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", types.BAD_REQUEST_ERROR, err)
+	}
+
+	_, err = queues.get(req.QueueName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// anything a consumer of the dead-letter queue is working on stays
+	query := db.Where("queue_name = ? AND dead_letter IS NOT NULL", req.QueueName).
+		Where("NOT EXISTS (SELECT 1 FROM deliveries WHERE deliveries.message_id = messages.id AND NOT deliveries.acked AND deliveries.connection != 0 AND deliveries.lock_date_time > ?)", time.Now()).
+		Order("id")
+	if len(req.MessageIds) > 0 {
+		query = query.Where("id IN ?", req.MessageIds)
+	} else if req.Limit > 0 {
+		query = query.Limit(req.Limit)
+	}
+
+	var msgs []types.Message
+	res := query.Find(&msgs)
+	if res.Error != nil {
+		return nil, nil, fmt.Errorf("error finding messages to redrive from %s: %w", req.QueueName, res.Error)
+	}
+
+	result := &types.RedriveResult{}
+	var sources []string
+	for _, msg := range msgs {
+		source, err := queues.get(msg.DeadLetter.QueueName)
+		if err != nil {
+			return result, sources, err
+		}
+
+		err = db.Transaction(func(tx *gorm.DB) error {
+			group := msg.DeadLetter.Group
+			assignPartition(&msg, source)
+
+			res := tx.Model(&types.Message{}).
+				Where("id = ? AND queue_name = ?", msg.ID, req.QueueName).
+				Updates(map[string]any{"queue_name": source.Name, "partition": msg.Partition, "dead_letter": nil, "expires_at": nil})
+			if res.Error != nil || res.RowsAffected == 0 {
+				// redriven by someone else in the meantime
+				return res.Error
+			}
+
+			// forget the dead-letter queue groups, and keep it from the groups
+			// that are done with it. Every group gets a message that expired
+			res = tx.Where("message_id = ?", msg.ID).Delete(&types.Delivery{})
+			if res.Error != nil {
+				return res.Error
+			}
+			if group != "" {
+				res = tx.Exec(
+					`INSERT INTO deliveries (message_id, group_name, queue_name, acked)
+					SELECT ?, name, queue_name, true FROM consumer_groups WHERE queue_name = ? AND name != ?`,
+					msg.ID,
+					source.Name,
+					group,
+				)
+				if res.Error != nil {
+					return res.Error
+				}
+			}
+
+			result.Count++
+			if !slices.Contains(sources, source.Name) {
+				sources = append(sources, source.Name)
+			}
+			return nil
+		})
+		if err != nil {
+			return result, sources, fmt.Errorf("error redriving message %d: %w", msg.ID, err)
+		}
+	}
+
+	slog.Info("Messages Redriven", "queue", req.QueueName, "count", result.Count)
+	return result, sources, nil
+}
+
+// removeAcked removes the messages every group of their queue acked
+func removeAcked(ids []uint, db *gorm.DB) error {
+	// process each batch separately
+	for _, batch := range utils.ChunkSlice(ids, batchSize) {
+		res := db.Where("id IN ?", batch).
+			Where(`NOT EXISTS (
+				SELECT 1 FROM consumer_groups WHERE consumer_groups.queue_name = messages.queue_name AND NOT EXISTS (
+					SELECT 1 FROM deliveries WHERE deliveries.message_id = messages.id AND deliveries.group_name = consumer_groups.name AND deliveries.acked
+				)
+			)`).
+			Delete(&types.Message{})
+		if res.Error != nil {
+			return res.Error
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package handler
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/playsthisgame/binq/types"
+)
+
+// how long a MessageKey is remembered by queues that don't ask for their own
+// window
+const defaultDedupWindow = 5 * time.Minute
+
+// errDuplicate rolls back the insert of a message that was published before
+var errDuplicate = errors.New("duplicate message")
+
+// storeMessage creates the message unless one with the same MessageKey was
+// published to the queue within its dedup window, then the first one is
+// returned instead. The message is inserted before looking, the write lock is
+// held from then on so two publishes of the same key can't both stay
+func storeMessage(msg *types.Message, queue *types.Queue, db *gorm.DB) (*types.PublishResult, error) {
+	if msg.MessageKey == "" {
+		res := db.Create(msg)
+		if res.Error != nil {
+			return nil, res.Error
+		}
+		return &types.PublishResult{MessageId: msg.ID}, nil
+	}
+
+	window := queue.DedupWindow
+	if window <= 0 {
+		window = defaultDedupWindow
+	}
+
+	var original []types.Message
+	err := db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Create(msg)
+		if res.Error != nil {
+			return res.Error
+		}
+
+		// received and acked ones count too
+		res = tx.Unscoped().
+			Select("id").
+			Where("queue_name = ? AND message_key = ? AND id < ? AND created_at > ?", msg.QueueName, msg.MessageKey, msg.ID, time.Now().Add(-window)).
+			Order("id").
+			Limit(1).
+			Find(&original)
+		if res.Error != nil {
+			return res.Error
+		}
+		if len(original) > 0 {
+			return errDuplicate
+		}
+		return nil
+	})
+	if errors.Is(err, errDuplicate) {
+		return &types.PublishResult{MessageId: original[0].ID, Duplicate: true}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &types.PublishResult{MessageId: msg.ID}, nil
+}
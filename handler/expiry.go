@@ -0,0 +1,233 @@
+package handler
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/playsthisgame/binq/types"
+)
+
+// how often expired messages are looked for, they aren't delivered either way
+const expiryInterval = 10 * time.Second
+
+// how often groups without consumers are looked for, the ones with consumers
+// are seen as often
+const groupExpiryInterval = time.Minute
+
+// ExpireMessages deals with the messages that expired before every group
+// acked them, following the expiry policy of their queue, and with the ones a
+// group ran out of deliveries for, until done is closed
+func (h *CommandHandler) ExpireMessages(done <-chan struct{}) {
+	ticker := time.NewTicker(expiryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		h.deadLetters()
+
+		var queueNames []string
+		res := h.db.Model(&types.Message{}).
+			Distinct("queue_name").
+			Where("expires_at <= ?", time.Now()).
+			Pluck("queue_name", &queueNames)
+		if res.Error != nil {
+			slog.Error("Error looking for expired messages", "error", res.Error)
+			continue
+		}
+
+		for _, name := range queueNames {
+			queue, err := h.queues.get(name)
+			if err != nil {
+				slog.Error("Error expiring messages", "queue", name, "error", err)
+				continue
+			}
+
+			deadLetterQueue, err := expire(queue, h.queues, h.db)
+			if err != nil {
+				slog.Error("Error expiring messages", "queue", name, "error", err)
+			}
+			if deadLetterQueue != "" {
+				h.published.notify(deadLetterQueue)
+			}
+		}
+	}
+}
+
+// expire removes the expired messages of a queue, copying them to its
+// dead-letter queue when the queue asks for it. Messages a consumer is working
+// on are left to it. It returns the dead-letter queue when anything was copied
+// to it
+func expire(queue *types.Queue, queues *queues, db *gorm.DB) (string, error) {
+	var deadLetterQueue *types.Queue
+	if queue.ExpiryPolicy == types.EXPIRY_DEAD_LETTER {
+		var err error
+		deadLetterQueue, err = deadLetterQueueOf(queue.DeadLetterQueue, queues)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	count := 0
+	_, err := moveToDeadLetters(deadLetterQueue, db, func(tx *gorm.DB, letter letterFunc) error {
+		now := time.Now()
+
+		var expired []struct{ ID uint }
+		res := tx.Raw(
+			`UPDATE messages SET deleted_at = ?
+			WHERE queue_name = ? AND deleted_at IS NULL AND expires_at <= ?
+			AND NOT EXISTS (SELECT 1 FROM deliveries WHERE deliveries.message_id = messages.id AND NOT deliveries.acked AND deliveries.connection != 0 AND deliveries.lock_date_time > ?)
+			RETURNING id`,
+			now,
+			queue.Name,
+			now,
+			now,
+		).Scan(&expired)
+		if res.Error != nil {
+			return res.Error
+		}
+		count = len(expired)
+		if count == 0 || deadLetterQueue == nil {
+			return nil
+		}
+
+		ids := make([]uint, len(expired))
+		for i, msg := range expired {
+			ids[i] = msg.ID
+		}
+
+		var msgs []types.Message
+		res = tx.Unscoped().Order("id").Find(&msgs, ids)
+		if res.Error != nil {
+			return res.Error
+		}
+
+		for i := range msgs {
+			msg := &msgs[i]
+			err := letter(msg, &types.DeadLetter{
+				QueueName: queue.Name,
+				MessageID: msg.ID,
+				Reason:    fmt.Sprintf("expired at %s", msg.ExpiresAt.Format(time.RFC3339)),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("error expiring messages of %s: %w", queue.Name, err)
+	}
+
+	if count == 0 {
+		return "", nil
+	}
+	if deadLetterQueue == nil {
+		slog.Info("Expired Messages Discarded", "queue", queue.Name, "count", count)
+		return "", nil
+	}
+	slog.Info("Expired Messages Dead-Lettered", "queue", queue.Name, "dead-letter queue", deadLetterQueue.Name, "count", count)
+	return deadLetterQueue.Name, nil
+}
+
+// ExpireGroups drops the consumer groups that went without consumers for
+// longer than the group expiry, until done is closed
+func (h *CommandHandler) ExpireGroups(done <-chan struct{}) {
+	if h.groupExpiry < 0 {
+		return
+	}
+
+	ticker := time.NewTicker(groupExpiryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		err := h.expireGroups()
+		if err != nil {
+			slog.Error("Error expiring consumer groups", "error", err)
+		}
+	}
+}
+
+func (h *CommandHandler) expireGroups() error {
+	now := time.Now()
+
+	// a group that gets a consumer after this was seen when it joined
+	h.mutex.RLock()
+	active := make([]groupKey, 0, len(h.groups))
+	for key := range h.groups {
+		active = append(active, key)
+	}
+	h.mutex.RUnlock()
+
+	for _, key := range active {
+		res := h.db.Model(&types.ConsumerGroup{}).
+			Where("queue_name = ? AND name = ?", key.queueName, key.group).
+			Update("last_seen", now)
+		if res.Error != nil {
+			return res.Error
+		}
+	}
+
+	cutoff := now.Add(-h.groupExpiry)
+	var expired []types.ConsumerGroup
+	res := h.db.Where("last_seen < ?", cutoff).Find(&expired)
+	if res.Error != nil {
+		return res.Error
+	}
+
+	for _, group := range expired {
+		dropped, err := dropGroup(&group, cutoff, h.db)
+		if err != nil {
+			return fmt.Errorf("error expiring consumer group %s of %s: %w", group.Name, group.QueueName, err)
+		}
+		if dropped {
+			slog.Info("Consumer Group Expired", "queue", group.QueueName, "group", group.Name, "last seen", group.LastSeen)
+		}
+	}
+	return nil
+}
+
+// dropGroup removes a consumer group that wasn't seen since cutoff with its
+// deliveries, the messages every other group acked are removed with it
+func dropGroup(group *types.ConsumerGroup, cutoff time.Time, db *gorm.DB) (bool, error) {
+	dropped := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// it may have had a consumer since it was looked up
+		res := tx.Where("queue_name = ? AND name = ? AND last_seen < ?", group.QueueName, group.Name, cutoff).
+			Delete(&types.ConsumerGroup{})
+		if res.Error != nil || res.RowsAffected == 0 {
+			return res.Error
+		}
+		dropped = true
+
+		res = tx.Where("queue_name = ? AND group_name = ?", group.QueueName, group.Name).Delete(&types.Delivery{})
+		if res.Error != nil {
+			return res.Error
+		}
+
+		var acked []uint
+		res = tx.Model(&types.Delivery{}).
+			Distinct("message_id").
+			Where("queue_name = ? AND acked AND message_id IN (SELECT id FROM messages WHERE queue_name = ? AND deleted_at IS NULL)", group.QueueName, group.QueueName).
+			Pluck("message_id", &acked)
+		if res.Error != nil {
+			return res.Error
+		}
+
+		return removeAcked(acked, tx)
+	})
+	return dropped && err == nil, err
+}
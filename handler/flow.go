@@ -0,0 +1,97 @@
+package handler
+
+import (
+	"sync"
+	"time"
+
+	"github.com/playsthisgame/binq/types"
+)
+
+// the most credit a consumer can have, grants past it are capped
+const maxCredit = 1 << 30
+
+// flow limits how many messages a consumer holds at once. With a prefetch the
+// consumer gets room back as it acks, with manual credit only when it grants it
+type flow struct {
+	mutex    sync.Mutex
+	prefetch int // no limit when 0
+	manual   bool
+	credit   int
+	unacked  map[uint]time.Time // when the lock of each message held by the consumer runs out
+	changed  chan struct{}      // closed when the consumer gets more room
+}
+
+func newFlow(req *types.ConsumerRequest) *flow {
+	return &flow{
+		prefetch: req.Prefetch,
+		manual:   req.ManualCredit,
+		credit:   min(req.Prefetch, maxCredit),
+		unacked:  make(map[uint]time.Time),
+		changed:  make(chan struct{}),
+	}
+}
+
+// available returns how many messages can be sent, -1 when there is no limit,
+// and a channel that is closed when that changes
+func (f *flow) available() (int, <-chan struct{}) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.manual {
+		return max(f.credit, 0), f.changed
+	}
+	if f.prefetch == 0 {
+		return -1, f.changed
+	}
+
+	// messages whose lock ran out are someone else's again
+	now := time.Now()
+	for id, expires := range f.unacked {
+		if !expires.After(now) {
+			delete(f.unacked, id)
+		}
+	}
+	return max(f.prefetch-len(f.unacked), 0), f.changed
+}
+
+func (f *flow) delivered(msgs []types.Message, expires time.Time) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for _, msg := range msgs {
+		f.unacked[msg.ID] = expires
+	}
+	if f.manual {
+		f.credit = max(f.credit-len(msgs), 0)
+	}
+}
+
+func (f *flow) acked(ids []uint) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	freed := false
+	for _, id := range ids {
+		if _, ok := f.unacked[id]; ok {
+			delete(f.unacked, id)
+			freed = true
+		}
+	}
+	if freed && !f.manual {
+		f.wake()
+	}
+}
+
+func (f *flow) grant(credit int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.credit = min(f.credit+min(credit, maxCredit), maxCredit)
+	f.wake()
+}
+
+// wake must be called with the mutex held
+func (f *flow) wake() {
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
@@ -1,270 +1,989 @@
 package handler
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
 	"slices"
+	"strconv"
 	"sync"
 	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
+	"github.com/playsthisgame/binq/store"
 	"github.com/playsthisgame/binq/types"
 	"github.com/playsthisgame/binq/utils"
 )
 
 const batchSize = 10
 
+// how long a consumer waits for a publish before looking for messages again,
+// unless it asked for something else. Locks that ran out are only noticed then
+const defaultWaitTime = 20 * time.Second
+
+// how long a delivered message stays with its consumer before it can be
+// delivered again
+const lockDuration = 10 * time.Minute
+
+// how long a message waits before it is received as if its priority was one
+// higher, unless the server asks for something else
+const defaultPriorityAging = time.Minute
+
+// how long a consumer group without consumers keeps its messages, unless the
+// server asks for something else
+const defaultGroupExpiry = 7 * 24 * time.Hour
+
+type Config struct {
+	MaxPartitions    int            // partitions of the queues that don't ask for their own
+	AutoCreateQueues bool           // create queues on first use instead of rejecting them
+	StoreCompressed  bool           // store bodies that were published compressed without decompressing them
+	Assignor         types.Assignor // splits the partitions between the consumers of a group, defaults to types.StickyAssignor
+	PriorityAging    time.Duration  // keeps low priorities from starving, defaults to defaultPriorityAging, never when negative
+	GroupExpiry      time.Duration  // drops groups without consumers for this long, defaults to defaultGroupExpiry, never when negative
+}
+
+// consumer groups are named per queue
+type groupKey struct {
+	queueName string
+	group     string
+}
+
 type CommandHandler struct {
 	db              *gorm.DB
-	consumerSockets []types.ConsumerSocket
-	maxPartitions   int
-	mutex           sync.RWMutex
+	groups          map[groupKey]*group // the consumers of each group, the partitions are split between them
+	assignor        types.Assignor
+	priorityAging   time.Duration
+	groupExpiry     time.Duration
+	queues          *queues
+	storeCompressed bool
+	mutex           sync.RWMutex // guards groups, flows and stopping, Handle is called for many connections at once
+	streams         map[streamKey]*stream
+	fetches         map[streamKey]*fetch // bodies being sent, guarded by streamMutex
+	bodies          sync.WaitGroup       // one for every sendBody
+	streamMutex     sync.Mutex
+	commands        map[types.Opcode]command
+	published       *notifier
+	flows           map[int]*flow // the flow control of each consumer by connection id, guarded by mutex
+
+	// closed by StopConsumers, every sendMessages in consumers returns once it is
+	stop      chan struct{}
+	stopping  bool
+	consumers sync.WaitGroup
 }
 
-func NewCommandHandler(db *gorm.DB, maxPartitions *int) *CommandHandler {
-	return &CommandHandler{
-		db:            db,
-		maxPartitions: *maxPartitions,
-		consumerSockets: make(
-			[]types.ConsumerSocket,
-			0,
-			*maxPartitions,
-		), // probably can use maxPartitions here
+func NewCommandHandler(db *gorm.DB, conf *Config) (*CommandHandler, error) {
+	var assignor types.Assignor = types.StickyAssignor{}
+	if conf.Assignor != nil {
+		assignor = conf.Assignor
+	}
+
+	priorityAging := defaultPriorityAging
+	if conf.PriorityAging != 0 {
+		priorityAging = conf.PriorityAging
+	}
+
+	groupExpiry := defaultGroupExpiry
+	if conf.GroupExpiry != 0 {
+		groupExpiry = conf.GroupExpiry
+	}
+
+	h := &CommandHandler{
+		db:              db,
+		queues:          newQueues(db, conf.AutoCreateQueues, conf.MaxPartitions),
+		storeCompressed: conf.StoreCompressed,
+		groups:          make(map[groupKey]*group),
+		assignor:        assignor,
+		priorityAging:   priorityAging,
+		groupExpiry:     groupExpiry,
+		streams:         make(map[streamKey]*stream),
+		fetches:         make(map[streamKey]*fetch),
+		commands:        make(map[types.Opcode]command),
+		stop:            make(chan struct{}),
+		published:       newNotifier(),
+		flows:           make(map[int]*flow),
 	}
+
+	// named after their opcode, the names live with the opcodes in types
+	builtins := map[types.Opcode]HandlerFunc{
+		types.CREATE:         h.create,
+		types.ALTER:          h.alter,
+		types.PUBLISH:        h.publish,
+		types.PUBLISH_BATCH:  h.publishBatch,
+		types.RECEIVE:        h.receive,
+		types.ACK:            h.ack,
+		types.NACK:           h.nack,
+		types.REDRIVE:        h.redrive,
+		types.PUBLISH_STREAM: h.publishStream,
+		types.CHUNK:          h.chunk,
+		types.CHUNK_END:      h.chunkEnd,
+		types.FETCH:          h.fetch,
+		types.FETCH_CREDIT:   h.fetchCredit,
+		types.CREDIT:         h.credit,
+		types.REVOKED:        h.revoked,
+	}
+	for op, handle := range builtins {
+		err := h.register(op, op.String(), handle)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return h, nil
 }
 
 func (h *CommandHandler) Handle(cmdWrapper *types.TCPCommandWrapper) error {
-	// TODO: figure out how to use iota,also move this to the struct?
-	const (
-		create  = "CREATE"
-		publish = "PUBLISH"
-		receive = "RECEIVE"
-		ack     = "ACK"
-		oust    = "OUST"
+	if cmdWrapper.Disconnected {
+		h.oust(cmdWrapper.Conn)
+		return nil
+	}
+
+	req := &Request{Conn: cmdWrapper.Conn, Command: cmdWrapper.Command}
+
+	op := cmdWrapper.Command.Command
+	cmd, ok := h.commands[op]
+	if !ok {
+		err := fmt.Errorf("%w %s", types.UNKNOWN_COMMAND_ERROR, op)
+		slog.Warn("unknown command", "id", cmdWrapper.Conn.Id, "command", op)
+		req.Reply(err)
+		return err
+	}
+
+	err := cmd.handle(req)
+	req.Reply(err)
+	if err != nil {
+		slog.Error("Error while handling command", "command", cmd.name, "error", err)
+		return err
+	}
+	return nil
+}
+
+func (h *CommandHandler) create(req *Request) error {
+	var queue types.Queue
+	err := req.Command.DecodeData(&queue)
+	if err != nil {
+		return fmt.Errorf("%w: error unmarshalling queue", types.BAD_REQUEST_ERROR)
+	}
+
+	_, err = h.queues.create(&queue)
+	return err
+}
+
+func (h *CommandHandler) alter(req *Request) error {
+	var queue types.Queue
+	err := req.Command.DecodeData(&queue)
+	if err != nil {
+		return fmt.Errorf("%w: error unmarshalling queue", types.BAD_REQUEST_ERROR)
+	}
+
+	updated, err := h.queues.alter(&queue)
+	if err != nil {
+		return err
+	}
+
+	// spread the new partitions over the consumers already reading the queue
+	h.mutex.Lock()
+	for key := range h.groups {
+		if key.queueName == updated.Name {
+			h.rebalance(key, updated.MaxPartitions)
+		}
+	}
+	h.mutex.Unlock()
+	return nil
+}
+
+func (h *CommandHandler) publish(req *Request) error {
+	msg, result, err := createMessage(req.Command, h.queues, h.storeCompressed, *h.db)
+	if err != nil {
+		return err
+	}
+	if !result.Duplicate {
+		h.published.notifyAt(msg.QueueName, msg.DeliverAt)
+	}
+	req.ReplyWith(result, nil)
+	return nil
+}
+
+func (h *CommandHandler) publishBatch(req *Request) error {
+	msgs, result, err := createMessages(req.Command, h.queues, h.storeCompressed, h.db)
+	if err != nil {
+		return err
+	}
+	for i, msg := range msgs {
+		stored := result.Results[i]
+		if stored.Err() == nil && !stored.Duplicate {
+			h.published.notifyAt(msg.QueueName, msg.DeliverAt)
+		}
+	}
+	req.ReplyWith(result, nil)
+	return nil
+}
+
+func (h *CommandHandler) receive(req *Request) error {
+	var request types.ConsumerRequest
+	err := req.Command.DecodeData(&request)
+	if err != nil {
+		req.Reply(fmt.Errorf("%w: %w", types.BAD_REQUEST_ERROR, err))
+		req.Conn.Close()
+		return err
+	}
+	if request.Prefetch < 0 {
+		return fmt.Errorf("%w: negative prefetch %d", types.BAD_REQUEST_ERROR, request.Prefetch)
+	}
+	if request.Group == "" {
+		request.Group = types.DEFAULT_CONSUMER_GROUP
+	}
+	if request.ConsumerId == "" {
+		request.ConsumerId = strconv.Itoa(req.Conn.Id)
+	}
+
+	// acks, credit and oust all find the consumer by its connection, the
+	// commands of a connection are handled one at a time so it can't race
+	if _, ok := h.flowOf(req.Conn); ok {
+		return fmt.Errorf("%w: connection %d is already a consumer", types.BAD_REQUEST_ERROR, req.Conn.Id)
+	}
+
+	queue, err := h.queues.get(request.QueueName)
+	if err != nil {
+		return err
+	}
+
+	// the group keeps the messages of the queue from being removed until it acks
+	// them, or until it goes without consumers for too long
+	group := types.ConsumerGroup{QueueName: request.QueueName, Name: request.Group, LastSeen: time.Now()}
+	res := h.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "queue_name"}, {Name: "name"}},
+		DoUpdates: clause.AssignmentColumns([]string{"last_seen"}),
+	}).Create(&group)
+	if res.Error != nil {
+		return fmt.Errorf("error creating consumer group %s for %s: %w", request.Group, request.QueueName, res.Error)
+	}
+
+	h.mutex.Lock()
+	if h.stopping {
+		h.mutex.Unlock()
+		return types.SHUTDOWN_ERROR
+	}
+
+	key := groupKey{queueName: request.QueueName, group: request.Group}
+	g, ok := h.groups[key]
+	if !ok {
+		g = newGroup()
+		h.groups[key] = g
+	}
+	if slices.ContainsFunc(g.consumers, func(consumer *types.ConsumerSocket) bool {
+		return consumer.Id == request.ConsumerId
+	}) {
+		h.mutex.Unlock()
+		return fmt.Errorf("%w: consumer %s is already in group %s", types.BAD_REQUEST_ERROR, request.ConsumerId, request.Group)
+	}
+
+	consumerSocket := types.NewConsumerSocket(request.ConsumerId, request.QueueName, request.Group, *req.Conn)
+	g.consumers = append(g.consumers, consumerSocket)
+	flow := newFlow(&request)
+	h.flows[req.Conn.Id] = flow
+	// counted before StopConsumers can start waiting
+	h.consumers.Add(1)
+	h.rebalance(key, queue.MaxPartitions)
+	h.mutex.Unlock()
+
+	partitions := consumerSocket.Assigned()
+	slog.Info(
+		"consumer added",
+		"queue",
+		consumerSocket.QueueName,
+		"group",
+		consumerSocket.Group,
+		"consumer",
+		consumerSocket.Id,
+		"partition count",
+		len(partitions),
+		"partitions",
+		partitions,
 	)
 
-	cmds := make(map[int]string)
-	cmds[1] = "CREATE"
-	cmds[2] = "PUBLISH"
-	cmds[3] = "RECEIVE"
-	cmds[4] = "ACK"
-	cmds[5] = "OUST"
+	// the consumer is waiting on this response, send it before any batches
+	req.Reply(nil)
 
-	cmd := cmdWrapper.Command.Command
+	go func() {
+		defer h.consumers.Done()
+		sendMessages(consumerSocket, flow, &request, req.Command, h.queues, h.db, h.priorityAging, h.published, h.stop)
+	}()
+	return nil
+}
 
-	op, ok := cmds[int(cmd)]
-	if ok {
-		switch op {
-		case create:
-			err := createQueue(cmdWrapper.Command.Data, *h.db)
-			if err != nil {
-				slog.Error("Error while create queue")
-				return err
-			}
-		case publish:
-			err := createMessage(cmdWrapper.Command.Data, h.maxPartitions, *h.db)
-			if err != nil {
-				slog.Error("Error while publishing")
-				return err
-			}
-		case receive:
-			var request types.ConsumerRequest
-			err := request.UnmarshalBinary(cmdWrapper.Command.Data)
-			if err != nil {
-				slog.Error("error unmarshalling message")
-				cmdWrapper.Conn.Close()
-				return err
-			}
+func (h *CommandHandler) ack(req *Request) error {
+	// only what was delivered on the connection can be acked on it
+	consumer, ok := h.consumerOf(req.Conn)
+	if !ok {
+		return fmt.Errorf("%w: connection %d is not a consumer", types.BAD_REQUEST_ERROR, req.Conn.Id)
+	}
 
-			consumerCount := len(h.consumerSockets) + 1
+	ids, result, err := ackMessages(req.Command, consumer, *h.db)
+	if err != nil {
+		return err
+	}
+	if len(result.RejectedIds) > 0 || len(result.RejectedReceipts) > 0 {
+		slog.Warn("acks rejected", "id", req.Conn.Id, "consumer", consumer.Id, "ids", result.RejectedIds, "receipts", result.RejectedReceipts)
+	}
 
-			// make a new consumer socket
-			consumerSocket, err := types.NewConsumerSocket(
-				consumerCount,
-				consumerCount,
-				h.maxPartitions,
-				request.QueueName,
-				*cmdWrapper.Conn,
-			)
-			if err != nil {
-				slog.Error("Error create client socket", "id", cmdWrapper.Conn.Id, "error", err)
-				cmdWrapper.Conn.Close()
-				return err
-			}
+	// acked messages make room for more
+	if flow, ok := h.flowOf(req.Conn); ok {
+		flow.acked(ids)
+	}
+	req.ReplyWith(result, nil)
+	return nil
+}
 
-			h.mutex.Lock()
-			h.consumerSockets = append(h.consumerSockets, *consumerSocket)
-			h.mutex.Unlock()
+func (h *CommandHandler) nack(req *Request) error {
+	consumer, ok := h.consumerOf(req.Conn)
+	if !ok {
+		return fmt.Errorf("%w: connection %d is not a consumer", types.BAD_REQUEST_ERROR, req.Conn.Id)
+	}
 
-			rebalanceConsumers(h)
+	ids, result, delay, err := nackMessages(req.Command, consumer, *h.db)
+	if err != nil {
+		return err
+	}
+	if len(result.RejectedIds) > 0 || len(result.RejectedReceipts) > 0 {
+		slog.Warn("nacks rejected", "id", req.Conn.Id, "consumer", consumer.Id, "ids", result.RejectedIds, "receipts", result.RejectedReceipts)
+	}
 
-			slog.Info(
-				"consumer added",
-				"instance",
-				consumerSocket.Instance,
-				"partition count",
-				len(consumerSocket.Partitions),
-				"partitions",
-				consumerSocket.Partitions,
-			)
+	// handed back messages make room like acked ones
+	if flow, ok := h.flowOf(req.Conn); ok {
+		flow.acked(ids)
+	}
 
-			go sendMessages(consumerSocket, &request, h.db)
+	// the group can have them again once the delay is over
+	if len(ids) > 0 {
+		h.published.notifyAt(consumer.QueueName, time.Now().Add(delay))
+	}
+	req.ReplyWith(result, nil)
+	return nil
+}
 
-		case ack:
-			err := ackMessages(cmdWrapper.Command.Data, *h.db)
-			if err != nil {
-				slog.Error("Error while create queue")
-			}
-		case oust:
-			// oust consumer socket
-			for i := len(h.consumerSockets) - 1; i >= 0; i-- {
-				if h.consumerSockets[i].Conn.Id == cmdWrapper.Conn.Id {
-					h.mutex.Lock()
-					h.consumerSockets = slices.Delete(h.consumerSockets, i, i+1)
-					h.mutex.Unlock()
-
-					slog.Info("ousting consumer", "id", cmdWrapper.Conn.Id)
-					break
-				}
-			}
-			// reset the consumer socket instances
-			for i := range h.consumerSockets {
-				h.consumerSockets[i].Instance = i + 1
-			}
-			// rebalance after ousting
-			if len(h.consumerSockets) > 0 {
-				rebalanceConsumers(h)
+func (h *CommandHandler) redrive(req *Request) error {
+	result, sources, err := redrive(req.Command, h.queues, h.db)
+	for _, source := range sources {
+		h.published.notify(source)
+	}
+	if err != nil {
+		return err
+	}
+	req.ReplyWith(result, nil)
+	return nil
+}
+
+func (h *CommandHandler) credit(req *Request) error {
+	var credit types.Credit
+	err := req.Command.DecodeData(&credit)
+	if err != nil {
+		return fmt.Errorf("%w: %w", types.BAD_REQUEST_ERROR, err)
+	}
+
+	flow, ok := h.flowOf(req.Conn)
+	if !ok {
+		return fmt.Errorf("%w: connection %d is not a consumer", types.BAD_REQUEST_ERROR, req.Conn.Id)
+	}
+	if !flow.manual {
+		return fmt.Errorf("%w: consumer %d gets credit back as it acks", types.BAD_REQUEST_ERROR, req.Conn.Id)
+	}
+	if credit.Count <= 0 {
+		return fmt.Errorf("%w: credit %d is not positive", types.BAD_REQUEST_ERROR, credit.Count)
+	}
+	flow.grant(credit.Count)
+	return nil
+}
+
+func (h *CommandHandler) flowOf(conn *types.Connection) (*flow, bool) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	flow, ok := h.flows[conn.Id]
+	return flow, ok
+}
+
+func (h *CommandHandler) consumerOf(conn *types.Connection) (*types.ConsumerSocket, bool) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	for _, g := range h.groups {
+		for _, consumer := range g.consumers {
+			if consumer.Conn.Id == conn.Id {
+				return consumer, true
 			}
 		}
 	}
+	return nil, false
+}
+
+func (h *CommandHandler) publishStream(req *Request) error {
+	err := h.beginStream(req.Command, req.Conn)
+	if err == nil {
+		// success is answered at the CHUNK_END
+		req.NoReply()
+	}
+	return err
+}
+
+func (h *CommandHandler) chunk(req *Request) error {
+	err := h.writeChunk(req.Command, req.Conn)
+	if err == nil {
+		req.NoReply()
+	}
+	return err
+}
+
+func (h *CommandHandler) chunkEnd(req *Request) error {
+	// the client gave up on a body it was fetching
+	if h.stopFetch(streamKey{connId: req.Conn.Id, requestId: req.Command.RequestId}) {
+		req.NoReply()
+		return nil
+	}
+
+	result, err := h.endStream(req.Command, req.Conn)
+	if err == nil {
+		req.ReplyWith(result, nil)
+	}
+	return err
+}
+
+func (h *CommandHandler) fetch(req *Request) error {
+	msg, window, err := fetchMessage(req.Command, req.Conn, h.db)
+	if err != nil {
+		return err
+	}
+
+	// the body follows the response, credit can come in as soon as it is sent
+	f := h.startFetch(streamKey{connId: req.Conn.Id, requestId: req.Command.RequestId}, window)
+	req.Reply(nil)
+	h.bodies.Add(1)
+	go func() {
+		defer h.bodies.Done()
+		h.sendBody(msg, req.Command, req.Conn, f)
+	}()
 	return nil
 }
 
-func rebalanceConsumers(h *CommandHandler) {
-	for i := range h.consumerSockets {
-		// h.mutex.Lock()
-		(h.consumerSockets)[i].Partitions = types.SetPartitions(
-			(h.consumerSockets)[i].Instance,
-			len(h.consumerSockets),
-			h.maxPartitions,
-		)
-		slog.Debug(
-			"consumer rebalanced",
-			"instance",
-			(h.consumerSockets)[i].Instance,
-			"partition count",
-			len((h.consumerSockets)[i].Partitions),
-			"partitions",
-			(h.consumerSockets)[i].Partitions,
-		)
-		// h.mutex.Unlock()
-	}
-}
-
-func createQueue(data []byte, db gorm.DB) error {
-	var queue types.Queue
-	err := json.Unmarshal(data, &queue)
+func (h *CommandHandler) fetchCredit(req *Request) error {
+	var credit types.Credit
+	err := req.Command.DecodeData(&credit)
 	if err != nil {
-		return errors.New("error unmarshalling queue")
+		return fmt.Errorf("%w: %w", types.BAD_REQUEST_ERROR, err)
+	}
+	if credit.Count <= 0 {
+		return fmt.Errorf("%w: credit %d is not positive", types.BAD_REQUEST_ERROR, credit.Count)
 	}
 
-	res := db.Create(&queue)
+	h.grantFetch(streamKey{connId: req.Conn.Id, requestId: req.Command.RequestId}, credit.Count)
+	req.NoReply()
+	return nil
+}
+
+// oust drops everything a closed connection had going
+func (h *CommandHandler) oust(conn *types.Connection) {
+	// drop anything the connection was still publishing
+	h.dropStreams(conn)
+
+	consumer := h.dropConsumer(conn)
+	if consumer == nil {
+		return
+	}
+
+	// what it was sent and didn't ack can be received again right away instead
+	// of once its locks run out
+	res := h.db.Model(&types.Delivery{}).
+		Where("queue_name = ? AND group_name = ? AND connection = ? AND NOT acked AND lock_date_time > ?", consumer.QueueName, consumer.Group, conn.Id, time.Now()).
+		Updates(map[string]any{"lock_date_time": nil, "connection": 0})
 	if res.Error != nil {
-		return errors.New(fmt.Sprintf("Error creating queue %s", queue.Name))
+		slog.Error("Error releasing locks", "queue", consumer.QueueName, "group", consumer.Group, "consumer", consumer.Id, "error", res.Error)
+		return
+	}
+	if res.RowsAffected > 0 {
+		slog.Debug("locks released", "queue", consumer.QueueName, "group", consumer.Group, "consumer", consumer.Id, "count", res.RowsAffected)
+		h.published.notify(consumer.QueueName)
+	}
+}
+
+// dropConsumer takes the consumer of the connection out of its group and
+// rebalances the group, it returns nil when the connection wasn't a consumer
+func (h *CommandHandler) dropConsumer(conn *types.Connection) *types.ConsumerSocket {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	delete(h.flows, conn.Id)
+
+	for key, g := range h.groups {
+		i := slices.IndexFunc(g.consumers, func(consumer *types.ConsumerSocket) bool {
+			return consumer.Conn.Id == conn.Id
+		})
+		if i < 0 {
+			continue
+		}
+
+		consumer := g.consumers[i]
+		g.consumers = slices.Delete(g.consumers, i, i+1)
+		slog.Info("ousting consumer", "id", conn.Id, "queue", key.queueName, "group", key.group, "consumer", consumer.Id)
+
+		// stop sending before its partitions go to someone else, a claim that
+		// is under way finishes first
+		consumer.Sending.Lock()
+		consumer.Assign(nil)
+		consumer.Close()
+		consumer.Sending.Unlock()
+		if len(g.consumers) == 0 {
+			delete(h.groups, key)
+			return consumer
+		}
+
+		// it can't finish what it was revoked anymore
+		delete(g.assigned, consumer.Id)
+		for partition, holder := range g.revoking {
+			if holder == consumer {
+				delete(g.revoking, partition)
+			}
+		}
+
+		// rebalance after ousting
+		queue, err := h.queues.get(key.queueName)
+		if err != nil {
+			slog.Error("Error rebalancing consumers", "queue", key.queueName, "error", err)
+			return consumer
+		}
+		h.rebalance(key, queue.MaxPartitions)
+		return consumer
 	}
-	slog.Info("Queue Created", "name", queue.Name)
 	return nil
 }
 
-// assign the partition to the message here
-func createMessage(data []byte, maxPartitions int, db gorm.DB) error {
+// assign the partition to the message here, a duplicate isn't stored
+func createMessage(cmd *types.TCPCommand, queues *queues, storeCompressed bool, db gorm.DB) (*types.Message, *types.PublishResult, error) {
 	var msg types.Message
-	err := msg.UnmarshalBinary(data)
+	err := cmd.DecodeData(&msg)
 	if err != nil {
 		slog.Error("error unmarshalling binary", "error", err)
-		return errors.New("error unmarshalling message")
+		return nil, nil, fmt.Errorf("%w: error unmarshalling message", types.BAD_REQUEST_ERROR)
 	}
-	// assign the partition
-	msg.Partition = utils.RandRange(1, maxPartitions)
 
-	res := db.Create(&msg)
-	if res.Error != nil {
-		return errors.New(fmt.Sprintf("Error creating message for %s", msg.QueueName))
+	queue, err := prepareMessage(&msg, cmd.Codec(), queues, storeCompressed)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result, err := storeMessage(&msg, queue, &db)
+	if err != nil {
+		return nil, nil, errors.New(fmt.Sprintf("Error creating message for %s", msg.QueueName))
+	}
+	if result.Duplicate {
+		slog.Info("Duplicate Message Dropped", "queue", msg.QueueName, "key", msg.MessageKey, "original", result.MessageId)
+		return &msg, result, nil
 	}
 	slog.Info("Message Created for Queue", "queue", msg.QueueName, "size", len(msg.Data))
+	return &msg, result, nil
+}
+
+// createMessages stores the messages of a batch in one transaction, the ones
+// that can't be stored get their error in the result and the others are
+// stored anyway. It fails as a whole when the transaction does
+func createMessages(cmd *types.TCPCommand, queues *queues, storeCompressed bool, db *gorm.DB) ([]types.Message, *types.PublishBatchResult, error) {
+	var batch types.MessageBatch
+	err := cmd.DecodeData(&batch)
+	if err != nil {
+		slog.Error("error unmarshalling binary", "error", err)
+		return nil, nil, fmt.Errorf("%w: error unmarshalling message batch", types.BAD_REQUEST_ERROR)
+	}
+
+	msgs := batch.Messages
+	result := &types.PublishBatchResult{Results: make([]types.PublishResult, len(msgs))}
+	batchQueues := make([]*types.Queue, len(msgs))
+	for i := range msgs {
+		batchQueues[i], err = prepareMessage(&msgs[i], cmd.Codec(), queues, storeCompressed)
+		if err != nil {
+			res := types.NewResponse(err)
+			result.Results[i].Status, result.Results[i].Error = res.Status, res.Error
+		}
+	}
+
+	created := 0
+	err = db.Transaction(func(tx *gorm.DB) error {
+		created = 0
+		for i := range msgs {
+			if batchQueues[i] == nil {
+				continue
+			}
+			stored, err := storeMessage(&msgs[i], batchQueues[i], tx)
+			if err != nil {
+				return err
+			}
+			result.Results[i] = *stored
+			if !stored.Duplicate {
+				created++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating batch of %d messages: %w", len(msgs), err)
+	}
+
+	slog.Info("Message Batch Created", "messages", len(msgs), "created", created)
+	return msgs, result, nil
+}
+
+// prepareMessage readies a published message to be stored in its queue and
+// returns the queue
+func prepareMessage(msg *types.Message, codec types.Codec, queues *queues, storeCompressed bool) (*types.Queue, error) {
+	err := scheduleMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	queue, err := queues.get(msg.QueueName)
+	if err != nil {
+		return nil, err
+	}
+	err = expireMessage(msg, queue)
+	if err != nil {
+		return nil, err
+	}
+
+	// the producer thought the body was worth compressing, keep it that way
+	if storeCompressed && codec != types.CODEC_NONE && msg.Compression == types.CODEC_NONE {
+		msg.Data, err = types.Compress(codec, msg.Data)
+		if err != nil {
+			return nil, fmt.Errorf("error compressing message for %s: %w", msg.QueueName, err)
+		}
+		msg.Compression = codec
+	}
+	assignPartition(msg, queue)
+	return queue, nil
+}
+
+// scheduleMessage turns the Delay of a message into the time it is due
+func scheduleMessage(msg *types.Message) error {
+	if msg.Delay < 0 {
+		return fmt.Errorf("%w: negative delay %s", types.BAD_REQUEST_ERROR, msg.Delay)
+	}
+	if msg.Delay > 0 {
+		if !msg.DeliverAt.IsZero() {
+			return fmt.Errorf("%w: a message can have a DeliverAt or a Delay, not both", types.BAD_REQUEST_ERROR)
+		}
+		msg.DeliverAt = time.Now().Add(msg.Delay)
+		msg.Delay = 0
+	}
+	return nil
+}
+
+// expireMessage turns the TTL of a message, or the default TTL of its queue
+// when it has none, into the time it expires. The TTL runs from when the
+// message is due
+func expireMessage(msg *types.Message, queue *types.Queue) error {
+	if msg.TTL < 0 {
+		return fmt.Errorf("%w: negative TTL %s", types.BAD_REQUEST_ERROR, msg.TTL)
+	}
+	if msg.TTL > 0 && msg.ExpiresAt != nil {
+		return fmt.Errorf("%w: a message can have an ExpiresAt or a TTL, not both", types.BAD_REQUEST_ERROR)
+	}
+	if msg.TTL == 0 && msg.ExpiresAt == nil {
+		msg.TTL = queue.DefaultTTL
+	}
+	if msg.TTL > 0 {
+		due := time.Now()
+		if msg.DeliverAt.After(due) {
+			due = msg.DeliverAt
+		}
+		expiresAt := due.Add(msg.TTL)
+		msg.ExpiresAt = &expiresAt
+		msg.TTL = 0
+	}
 	return nil
 }
 
-func sendMessages(consumer *types.ConsumerSocket, req *types.ConsumerRequest, db *gorm.DB) error {
+// assignPartition puts messages with the same PartitionKey in the same
+// partition so they are received in order by one consumer, the others go
+// anywhere. Altering the partitions of the queue moves keys to new partitions
+func assignPartition(msg *types.Message, queue *types.Queue) {
+	if msg.PartitionKey != "" {
+		msg.Partition = utils.KeyPartition(msg.PartitionKey, queue.MaxPartitions)
+		return
+	}
+	msg.Partition = utils.RandRange(1, queue.MaxPartitions)
+}
+
+func sendMessages(
+	consumer *types.ConsumerSocket,
+	flow *flow,
+	req *types.ConsumerRequest,
+	receive *types.TCPCommand,
+	queues *queues,
+	db *gorm.DB,
+	priorityAging time.Duration,
+	published *notifier,
+	stop <-chan struct{},
+) error {
+	waitTime := req.WaitTime
+	if waitTime <= 0 {
+		waitTime = defaultWaitTime
+	}
+
 	for {
-		var msgs []types.Message
-		db.Limit(req.BatchSize).
-			Where("queue_name = ? AND partition IN ? AND (lock_date_time IS NULL OR lock_date_time <= ?)", consumer.QueueName, consumer.Partitions, time.Now()).
-			Find(&msgs)
+		select {
+		case <-consumer.Done():
+			return nil
+		case <-stop:
+			// nothing more is coming, the consumer can stop waiting
+			return consumer.Conn.Write(consumer.Conn.Reply(receive, types.GOAWAY))
+		default:
+		}
+
+		// hold off while the consumer has all it can take
+		limit := req.BatchSize
+		room, changed := flow.available()
+		if room == 0 {
+			timer := time.NewTimer(waitTime)
+			select {
+			case <-consumer.Done():
+			case <-stop:
+			case <-changed:
+			case <-timer.C:
+			}
+			timer.Stop()
+			continue
+		}
+		if room > 0 && (limit <= 0 || room < limit) {
+			limit = room
+		}
+
+		wake := published.wait(consumer.QueueName)
+
+		// the queue can be altered while the consumer reads it
+		queue, err := queues.get(consumer.QueueName)
+		if err != nil {
+			return err
+		}
+
+		// a REVOKE can't be written until the batch is, it isn't followed by
+		// anything from the partitions it revokes
+		consumer.Sending.Lock()
+		select {
+		case <-consumer.Done():
+			// ousted, its partitions may be someone else's already
+			consumer.Sending.Unlock()
+			return nil
+		default:
+		}
+
+		// anything the group hasn't acked and nobody in it holds, by priority and
+		// then oldest first so a partition is received in the order it was
+		// published when its messages share a priority
+		expires := time.Now().Add(lockDuration)
+		msgs, err := store.ClaimMessages(db, store.Claim{
+			QueueName:  consumer.QueueName,
+			Group:      consumer.Group,
+			Consumer:   consumer.Id,
+			Connection: consumer.Conn.Id,
+			Partitions: consumer.Assigned(),
+			Limit:      limit,
+			Until:      expires,
+
+			MaxDeliveries: queue.MaxDeliveries,
+			PriorityAging: priorityAging,
+		})
+		if err != nil {
+			// tried again once the wait is over
+			slog.Error("Error claiming messages", "queue", consumer.QueueName, "consumer", consumer.Id, "error", err)
+		}
+
+		// wait for something to be published rather than flooding the consumer
+		// with empty batches
+		if len(msgs) == 0 {
+			consumer.Sending.Unlock()
+			timer := time.NewTimer(waitTime)
+			select {
+			case <-consumer.Done():
+				timer.Stop()
+				continue
+			case <-stop:
+				timer.Stop()
+				continue
+			case <-wake:
+				timer.Stop()
+				continue
+			case <-timer.C:
+			}
+			if !req.EmptyBatches {
+				continue
+			}
+			consumer.Sending.Lock()
+			select {
+			case <-consumer.Done():
+				consumer.Sending.Unlock()
+				return nil
+			default:
+			}
+		}
+
+		// consumers that can't read compressed frames get the original bodies
+		if !consumer.Conn.Features.Has(types.FEATURE_COMPRESSION) {
+			for i := range msgs {
+				err := msgs[i].Decompress()
+				if err != nil {
+					consumer.Sending.Unlock()
+					return err
+				}
+			}
+		}
 
 		msgBatch := &types.MessageBatch{
 			Messages: msgs,
 		}
 
-		// lock messages
-		lockMessages(&msgs, db)
+		flow.delivered(msgs, expires)
 
-		// marshal data
-		data, err := msgBatch.MarshalBinary()
+		// marshal data, in whichever layout the consumer speaks
+		cmd := consumer.Conn.Reply(receive, 0)
+		err = cmd.EncodeData(msgBatch)
 		if err != nil {
+			consumer.Sending.Unlock()
 			return err
 		}
 
 		// write to client
-		err = consumer.Conn.Writer.Write(&types.TCPCommand{
-			Data: data,
-		})
+		err = consumer.Conn.Write(cmd)
+		consumer.Sending.Unlock()
 		if err != nil {
-			// TODO: if theres an error sending to the consumer, then remove it from consumer sockets
+			// the connection is gone, oust takes the consumer out of its group
 			return err
 		}
 	}
 }
 
-func lockMessages(msgs *[]types.Message, db *gorm.DB) {
-	ids := make([]uint, len(*msgs))
-	for i, msg := range *msgs {
-		ids[i] = msg.ID
+// ackMessages marks the messages acknowledged by the group of the consumer,
+// the ones every group of their queue acknowledged are removed. Only messages
+// leased to the connection of the consumer are acked, it returns their ids and
+// the acks that were rejected
+func ackMessages(cmd *types.TCPCommand, consumer *types.ConsumerSocket, db gorm.DB) ([]uint, *types.AckResult, error) {
+	var ackMessage types.AckMessages
+	err := cmd.DecodeData(&ackMessage)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", types.BAD_REQUEST_ERROR, err)
 	}
 
-	if len(ids) > 0 {
-		// Split ids into smaller batches
-		batches := utils.ChunkSlice(ids, batchSize)
-
-		// Process each batch separately
-		for _, batch := range batches {
-			db.Table("messages").
-				Where("id IN ?", batch).
-				Updates(types.Message{LockDateTime: time.Now().Add(time.Minute * 10)})
-		}
+	leases, err := leasesOf(cmd, consumer, ackMessage.MessageIds, ackMessage.Receipts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	acked, result, err := updateLeases(consumer, leases, db, "acked = true")
+	if err != nil {
+		return nil, nil, fmt.Errorf("error acknowledging messages: %w", err)
 	}
+
+	err = removeAcked(acked, &db)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error acknowledging messages: %w", err)
+	}
+	return acked, result, nil
 }
 
-func ackMessages(data []byte, db gorm.DB) error {
-	var ackMessage types.AckMessages
-	err := ackMessage.UnmarshalBinary(data)
+// nackMessages hands messages back to the group of the consumer, they can be
+// delivered again once the delay is over. It returns the ids of the messages
+// that were handed back and the ones that were rejected
+func nackMessages(cmd *types.TCPCommand, consumer *types.ConsumerSocket, db gorm.DB) ([]uint, *types.AckResult, time.Duration, error) {
+	var nack types.NackMessages
+	err := cmd.DecodeData(&nack)
 	if err != nil {
-		return err
+		return nil, nil, 0, fmt.Errorf("%w: %w", types.BAD_REQUEST_ERROR, err)
+	}
+	if nack.Delay < 0 {
+		return nil, nil, 0, fmt.Errorf("%w: negative delay %s", types.BAD_REQUEST_ERROR, nack.Delay)
+	}
+
+	leases, err := leasesOf(cmd, consumer, nack.MessageIds, nack.Receipts)
+	if err != nil {
+		return nil, nil, 0, err
 	}
 
-	if len(ackMessage.MessageIds) > 0 {
-		// split messageIds into chunks
-		batches := utils.ChunkSlice(ackMessage.MessageIds, batchSize)
+	// the lock stays until the delay is over, without a connection nobody can
+	// ack it until it is claimed again with a new receipt
+	nacked, result, err := updateLeases(
+		consumer,
+		leases,
+		db,
+		"lock_date_time = ?, connection = 0, history = json_set(coalesce(history, '[]'), '$[#-1].reason', ?)",
+		time.Now().Add(nack.Delay),
+		nack.Reason,
+	)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("error releasing messages: %w", err)
+	}
+	return nacked, result, nack.Delay, nil
+}
 
-		// process each batch separately
-		for _, batch := range batches {
-			var messages []types.Message
-			db.Delete(&messages, batch)
+// leasesOf is what an ACK or NACK matches leases by. Ids are only taken from
+// clients that predate receipts
+func leasesOf(cmd *types.TCPCommand, consumer *types.ConsumerSocket, ids []uint, receipts []string) (*types.AckMessages, error) {
+	if len(ids) > 0 && cmd.Version > types.JSON_VERSION {
+		return nil, fmt.Errorf("%w: messages are acked by receipt from version %d", types.BAD_REQUEST_ERROR, types.BINARY_VERSION)
+	}
+	if len(ids) == 0 && len(receipts) == 0 {
+		slog.Warn("nothing to ack", "id", consumer.Conn.Id, "consumer", consumer.Id, "command", cmd.Command)
+	}
+	return &types.AckMessages{MessageIds: ids, Receipts: receipts}, nil
+}
+
+// updateLeases sets the columns of the deliveries leased to the connection of
+// the consumer that match the receipts or ids. It returns the ids of the
+// messages that were updated and the receipts and ids that matched nothing
+func updateLeases(consumer *types.ConsumerSocket, leases *types.AckMessages, db gorm.DB, set string, values ...any) ([]uint, *types.AckResult, error) {
+	var updated []uint
+	result := &types.AckResult{}
+	now := time.Now()
+
+	update := func(match string, batch any) ([]types.Delivery, error) {
+		var deliveries []types.Delivery
+		args := append(slices.Clone(values), consumer.Group, consumer.Conn.Id, now, batch)
+		res := db.Raw(
+			`UPDATE deliveries SET `+set+`
+			WHERE group_name = ? AND connection = ? AND NOT acked AND lock_date_time > ? AND `+match+` IN ?
+			RETURNING message_id, receipt`,
+			args...,
+		).Scan(&deliveries)
+		return deliveries, res.Error
+	}
+
+	// split receipts into chunks
+	for _, batch := range utils.ChunkSlice(leases.Receipts, batchSize) {
+		deliveries, err := update("receipt", batch)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, receipt := range batch {
+			i := slices.IndexFunc(deliveries, func(delivery types.Delivery) bool { return delivery.Receipt == receipt })
+			if i < 0 {
+				result.RejectedReceipts = append(result.RejectedReceipts, receipt)
+				continue
+			}
+			updated = append(updated, deliveries[i].MessageID)
 		}
 	}
 
-	return nil
+	// split messageIds into chunks
+	for _, batch := range utils.ChunkSlice(leases.MessageIds, batchSize) {
+		deliveries, err := update("message_id", batch)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, id := range batch {
+			i := slices.IndexFunc(deliveries, func(delivery types.Delivery) bool { return delivery.MessageID == id })
+			if i < 0 {
+				result.RejectedIds = append(result.RejectedIds, id)
+				continue
+			}
+			updated = append(updated, id)
+		}
+	}
+
+	return updated, result, nil
 }
@@ -0,0 +1,126 @@
+package handler
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// notifier wakes the consumers of a queue when a message is published to it
+type notifier struct {
+	mutex     sync.Mutex
+	queues    map[string]chan struct{}
+	schedules map[string]*schedule // messages that aren't due yet, by queue
+}
+
+// schedule is one timer for a queue, set to the earliest of the times it has
+// to be notified at
+type schedule struct {
+	timer *time.Timer
+	times timeHeap
+}
+
+func newNotifier() *notifier {
+	return &notifier{
+		queues:    make(map[string]chan struct{}),
+		schedules: make(map[string]*schedule),
+	}
+}
+
+// wait returns a channel that is closed the next time the queue is notified,
+// take it before looking for messages so nothing published in between is missed
+func (n *notifier) wait(queueName string) <-chan struct{} {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	ch, ok := n.queues[queueName]
+	if !ok {
+		ch = make(chan struct{})
+		n.queues[queueName] = ch
+	}
+	return ch
+}
+
+// notifyAt notifies the queue once the time comes, right away when it already
+// has. For messages that can't be delivered before then
+func (n *notifier) notifyAt(queueName string, at time.Time) {
+	delay := time.Until(at)
+	if delay <= 0 {
+		n.notify(queueName)
+		return
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	s, ok := n.schedules[queueName]
+	if !ok {
+		s = &schedule{}
+		n.schedules[queueName] = s
+	}
+	heap.Push(&s.times, at)
+
+	if s.timer == nil {
+		s.timer = time.AfterFunc(delay, func() { n.due(queueName) })
+	} else if s.times[0].Equal(at) {
+		// earlier than what the timer was waiting for
+		s.timer.Reset(delay)
+	}
+}
+
+// due notifies the queue and sets its timer to the next time that isn't due
+// yet. A timer that was reset while firing can call it once more than needed
+func (n *notifier) due(queueName string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	s, ok := n.schedules[queueName]
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	for len(s.times) > 0 && !s.times[0].After(now) {
+		heap.Pop(&s.times)
+	}
+	n.notifyLocked(queueName)
+
+	if len(s.times) == 0 {
+		s.timer.Stop()
+		delete(n.schedules, queueName)
+		return
+	}
+	s.timer.Reset(s.times[0].Sub(now))
+}
+
+// notify wakes everything waiting on the queue
+func (n *notifier) notify(queueName string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.notifyLocked(queueName)
+}
+
+// notifyLocked is notify for callers holding n.mutex
+func (n *notifier) notifyLocked(queueName string) {
+	ch, ok := n.queues[queueName]
+	if ok {
+		close(ch)
+		delete(n.queues, queueName)
+	}
+}
+
+// timeHeap is a container/heap of times, the earliest first
+type timeHeap []time.Time
+
+func (h timeHeap) Len() int           { return len(h) }
+func (h timeHeap) Less(i, j int) bool { return h[i].Before(h[j]) }
+func (h timeHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *timeHeap) Push(x any) { *h = append(*h, x.(time.Time)) }
+
+func (h *timeHeap) Pop() any {
+	old := *h
+	t := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return t
+}
@@ -0,0 +1,290 @@
+package handler
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"gorm.io/gorm"
+
+	"github.com/playsthisgame/binq/types"
+)
+
+// queues caches the configuration of every queue, publishes and consumers
+// need the partition count of their queue
+type queues struct {
+	mutex  sync.RWMutex
+	db     *gorm.DB
+	byName map[string]*types.Queue
+
+	// queues that were never created are created on first use with the
+	// default partitions, otherwise using them is a bad request
+	autoCreate        bool
+	defaultPartitions int
+}
+
+func newQueues(db *gorm.DB, autoCreate bool, defaultPartitions int) *queues {
+	return &queues{
+		db:                db,
+		byName:            make(map[string]*types.Queue),
+		autoCreate:        autoCreate,
+		defaultPartitions: defaultPartitions,
+	}
+}
+
+// get returns the queue, creating it when the policy allows
+func (q *queues) get(name string) (*types.Queue, error) {
+	q.mutex.RLock()
+	queue, ok := q.byName[name]
+	q.mutex.RUnlock()
+	if ok {
+		return queue, nil
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.ensure(name)
+}
+
+// ensure loads the queue or creates it when the policy allows, q.mutex must be
+// held
+func (q *queues) ensure(name string) (*types.Queue, error) {
+	queue, err := q.load(name)
+	if err != nil {
+		return nil, err
+	}
+	if queue != nil {
+		return queue, nil
+	}
+
+	if !q.autoCreate {
+		return nil, fmt.Errorf("%w: queue %s does not exist", types.BAD_REQUEST_ERROR, name)
+	}
+	return q.insert(&types.Queue{Name: name})
+}
+
+// create adds a queue, creating one that exists is fine as long as it asks
+// for the same partitions, dead-lettering, expiry and dedup window
+func (q *queues) create(queue *types.Queue) (*types.Queue, error) {
+	if queue.Name == "" {
+		return nil, fmt.Errorf("%w: queue needs a name", types.BAD_REQUEST_ERROR)
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	existing, err := q.load(queue.Name)
+	if err != nil {
+		return nil, err
+	}
+	if existing == nil {
+		err = q.checkDeadLetterQueue(queue.Name, queue.DeadLetterQueue)
+		if err != nil {
+			return nil, err
+		}
+		err = checkExpiry(queue)
+		if err != nil {
+			return nil, err
+		}
+		return q.insert(queue)
+	}
+
+	if queue.MaxPartitions != 0 && queue.MaxPartitions != existing.MaxPartitions {
+		return nil, fmt.Errorf(
+			"%w: queue %s already exists with %d partitions",
+			types.BAD_REQUEST_ERROR,
+			queue.Name,
+			existing.MaxPartitions,
+		)
+	}
+	if (queue.MaxDeliveries != 0 && queue.MaxDeliveries != existing.MaxDeliveries) ||
+		(queue.DeadLetterQueue != "" && queue.DeadLetterQueue != existing.DeadLetterQueue) {
+		return nil, fmt.Errorf(
+			"%w: queue %s already exists with %d max deliveries and dead-letter queue %q",
+			types.BAD_REQUEST_ERROR,
+			queue.Name,
+			existing.MaxDeliveries,
+			existing.DeadLetterQueue,
+		)
+	}
+	if (queue.DefaultTTL != 0 && queue.DefaultTTL != existing.DefaultTTL) ||
+		(queue.ExpiryPolicy != 0 && queue.ExpiryPolicy != existing.ExpiryPolicy) {
+		return nil, fmt.Errorf(
+			"%w: queue %s already exists with default TTL %s and expiry policy %s",
+			types.BAD_REQUEST_ERROR,
+			queue.Name,
+			existing.DefaultTTL,
+			existing.ExpiryPolicy,
+		)
+	}
+	if queue.DedupWindow != 0 && queue.DedupWindow != existing.DedupWindow {
+		return nil, fmt.Errorf(
+			"%w: queue %s already exists with dedup window %s",
+			types.BAD_REQUEST_ERROR,
+			queue.Name,
+			existing.DedupWindow,
+		)
+	}
+	return existing, nil
+}
+
+// checkDeadLetterQueue makes sure the dead-letter queue of a queue can be
+// used, q.mutex must be held
+func (q *queues) checkDeadLetterQueue(name string, deadLetterQueue string) error {
+	if deadLetterQueue == "" {
+		return nil
+	}
+	if deadLetterQueue == name {
+		return fmt.Errorf("%w: queue %s can't be its own dead-letter queue", types.BAD_REQUEST_ERROR, name)
+	}
+	_, err := q.ensure(deadLetterQueue)
+	return err
+}
+
+// checkExpiry makes sure the messages of a queue can expire the way it asks,
+// and be deduplicated for a while
+func checkExpiry(queue *types.Queue) error {
+	if queue.DefaultTTL < 0 {
+		return fmt.Errorf("%w: negative default TTL %s", types.BAD_REQUEST_ERROR, queue.DefaultTTL)
+	}
+	if queue.DedupWindow < 0 {
+		return fmt.Errorf("%w: negative dedup window %s", types.BAD_REQUEST_ERROR, queue.DedupWindow)
+	}
+	switch queue.ExpiryPolicy {
+	case 0, types.EXPIRY_DISCARD:
+	case types.EXPIRY_DEAD_LETTER:
+		if queue.DeadLetterQueue == "" {
+			return fmt.Errorf("%w: queue %s dead-letters expired messages without a dead-letter queue", types.BAD_REQUEST_ERROR, queue.Name)
+		}
+	default:
+		return fmt.Errorf("%w: unknown expiry policy %d", types.BAD_REQUEST_ERROR, queue.ExpiryPolicy)
+	}
+	return nil
+}
+
+// alter changes the partitions, dead-lettering, expiry and dedup window of a
+// queue, whatever is left at zero stays as it is. Partitions can only grow
+// since the messages in the partitions that would go away couldn't be received
+func (q *queues) alter(queue *types.Queue) (*types.Queue, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	existing, err := q.load(queue.Name)
+	if err != nil {
+		return nil, err
+	}
+	if existing == nil {
+		return nil, fmt.Errorf("%w: queue %s does not exist", types.BAD_REQUEST_ERROR, queue.Name)
+	}
+	if queue.MaxPartitions != 0 && queue.MaxPartitions < existing.MaxPartitions {
+		return nil, fmt.Errorf(
+			"%w: queue %s has %d partitions, they can't be reduced to %d",
+			types.BAD_REQUEST_ERROR,
+			queue.Name,
+			existing.MaxPartitions,
+			queue.MaxPartitions,
+		)
+	}
+
+	err = q.checkDeadLetterQueue(queue.Name, queue.DeadLetterQueue)
+	if err != nil {
+		return nil, err
+	}
+
+	updated := *existing
+	if queue.MaxPartitions != 0 {
+		updated.MaxPartitions = queue.MaxPartitions
+	}
+	if queue.MaxDeliveries != 0 {
+		updated.MaxDeliveries = queue.MaxDeliveries
+	}
+	if queue.DeadLetterQueue != "" {
+		updated.DeadLetterQueue = queue.DeadLetterQueue
+	}
+	if queue.DefaultTTL != 0 {
+		updated.DefaultTTL = queue.DefaultTTL
+	}
+	if queue.ExpiryPolicy != 0 {
+		updated.ExpiryPolicy = queue.ExpiryPolicy
+	}
+	if queue.DedupWindow != 0 {
+		updated.DedupWindow = queue.DedupWindow
+	}
+	err = checkExpiry(&updated)
+	if err != nil {
+		return nil, err
+	}
+
+	res := q.db.Model(&updated).Updates(map[string]any{
+		"max_partitions":    updated.MaxPartitions,
+		"max_deliveries":    updated.MaxDeliveries,
+		"dead_letter_queue": updated.DeadLetterQueue,
+		"default_ttl":       updated.DefaultTTL,
+		"expiry_policy":     updated.ExpiryPolicy,
+		"dedup_window":      updated.DedupWindow,
+	})
+	if res.Error != nil {
+		return nil, fmt.Errorf("error altering queue %s: %w", queue.Name, res.Error)
+	}
+	q.byName[queue.Name] = &updated
+
+	slog.Info(
+		"Queue Altered",
+		"name",
+		queue.Name,
+		"partitions",
+		updated.MaxPartitions,
+		"max deliveries",
+		updated.MaxDeliveries,
+		"dead-letter queue",
+		updated.DeadLetterQueue,
+		"default TTL",
+		updated.DefaultTTL,
+		"expiry policy",
+		updated.ExpiryPolicy,
+		"dedup window",
+		updated.DedupWindow,
+	)
+	return &updated, nil
+}
+
+// load reads a queue into the cache, it returns nil when there is no such
+// queue. q.mutex must be held
+func (q *queues) load(name string) (*types.Queue, error) {
+	if queue, ok := q.byName[name]; ok {
+		return queue, nil
+	}
+
+	var queues []types.Queue
+	res := q.db.Where("name = ?", name).Order("id").Limit(1).Find(&queues)
+	if res.Error != nil {
+		return nil, fmt.Errorf("error loading queue %s: %w", name, res.Error)
+	}
+	if len(queues) == 0 {
+		return nil, nil
+	}
+
+	queue := &queues[0]
+	// queues created before partitions were per queue
+	if queue.MaxPartitions <= 0 {
+		queue.MaxPartitions = q.defaultPartitions
+	}
+	q.byName[name] = queue
+	return queue, nil
+}
+
+// insert stores a new queue, q.mutex must be held
+func (q *queues) insert(queue *types.Queue) (*types.Queue, error) {
+	if queue.MaxPartitions <= 0 {
+		queue.MaxPartitions = q.defaultPartitions
+	}
+
+	res := q.db.Create(queue)
+	if res.Error != nil {
+		return nil, fmt.Errorf("Error creating queue %s: %w", queue.Name, res.Error)
+	}
+	q.byName[queue.Name] = queue
+
+	slog.Info("Queue Created", "name", queue.Name, "partitions", queue.MaxPartitions)
+	return queue, nil
+}
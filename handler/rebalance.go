@@ -0,0 +1,174 @@
+package handler
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/playsthisgame/binq/types"
+)
+
+// the consumers of a group and the partitions each of them has
+type group struct {
+	consumers []*types.ConsumerSocket
+	assigned  map[string][]int // what the assignor gave each consumer, by id
+
+	// partitions still held by the consumer they were revoked from, the new
+	// owner only gets them once it is done with them
+	revoking map[int]*types.ConsumerSocket
+}
+
+func newGroup() *group {
+	return &group{
+		assigned: make(map[string][]int),
+		revoking: make(map[int]*types.ConsumerSocket),
+	}
+}
+
+// rebalance has the assignor split the partitions of the queue over the
+// consumers of a group. Consumers losing partitions are sent a REVOKE and
+// keep them from the others until they answer, unless their client predates
+// REVOKE. h.mutex must be held
+func (h *CommandHandler) rebalance(key groupKey, partitions int) {
+	g := h.groups[key]
+
+	members := make([]string, len(g.consumers))
+	current := make(map[string][]int, len(g.consumers))
+	for i, consumer := range g.consumers {
+		members[i] = consumer.Id
+		current[consumer.Id] = g.assigned[consumer.Id]
+	}
+	g.assigned = h.assignor.Assign(members, partitions, current)
+
+	for _, consumer := range g.consumers {
+		kept := g.assigned[consumer.Id]
+
+		// partitions coming back before the consumer was done with them
+		for partition, holder := range g.revoking {
+			if holder == consumer && slices.Contains(kept, partition) {
+				delete(g.revoking, partition)
+			}
+		}
+
+		// clients from before REVOKE would never answer, they lose their
+		// partitions right away
+		if !answersRevoke(consumer) {
+			continue
+		}
+
+		var lost []int
+		for _, partition := range consumer.Assigned() {
+			if !slices.Contains(kept, partition) {
+				lost = append(lost, partition)
+				g.revoking[partition] = consumer
+			}
+		}
+		if len(lost) > 0 {
+			h.revoke(key, consumer, lost)
+		}
+	}
+
+	h.applyAssignments(key)
+}
+
+// answersRevoke tells whether the consumer's client knows REVOKE, the ones
+// writing JSON_VERSION or older don't
+func answersRevoke(consumer *types.ConsumerSocket) bool {
+	return consumer.Conn.NewCommand(types.REVOKE, 0).Version > types.JSON_VERSION
+}
+
+// applyAssignments gives every consumer of the group what it was assigned,
+// less what another consumer is still being revoked, h.mutex must be held
+func (h *CommandHandler) applyAssignments(key groupKey) {
+	g := h.groups[key]
+	for _, consumer := range g.consumers {
+		partitions := make([]int, 0, len(g.assigned[consumer.Id]))
+		for _, partition := range g.assigned[consumer.Id] {
+			if _, ok := g.revoking[partition]; !ok {
+				partitions = append(partitions, partition)
+			}
+		}
+		consumer.Assign(partitions)
+		slog.Debug(
+			"consumer rebalanced",
+			"queue",
+			key.queueName,
+			"group",
+			key.group,
+			"consumer",
+			consumer.Id,
+			"partition count",
+			len(partitions),
+			"partitions",
+			partitions,
+		)
+	}
+	// consumers may have been given partitions with messages waiting
+	h.published.notify(key.queueName)
+}
+
+// revoke tells the consumer it is losing the partitions. It is written
+// between batches so nothing from them follows it, consumers that never answer
+// lose them once what they were sent is unlocked anyway
+func (h *CommandHandler) revoke(key groupKey, consumer *types.ConsumerSocket, partitions []int) {
+	slog.Info("revoking partitions", "queue", key.queueName, "group", key.group, "consumer", consumer.Id, "partitions", partitions)
+
+	go func() {
+		consumer.Sending.Lock()
+		defer consumer.Sending.Unlock()
+
+		cmd := consumer.Conn.NewCommand(types.REVOKE, 0)
+		err := cmd.EncodeData(&types.Revocation{Partitions: partitions})
+		if err == nil {
+			err = consumer.Conn.Write(cmd)
+		}
+		if err != nil {
+			slog.Error("Error revoking partitions", "consumer", consumer.Id, "error", err)
+		}
+	}()
+
+	time.AfterFunc(lockDuration, func() {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		h.release(key, consumer, partitions)
+	})
+}
+
+// release hands the partitions the consumer was revoked to their new owners,
+// h.mutex must be held
+func (h *CommandHandler) release(key groupKey, consumer *types.ConsumerSocket, partitions []int) {
+	g, ok := h.groups[key]
+	if !ok {
+		return
+	}
+
+	released := false
+	for _, partition := range partitions {
+		if g.revoking[partition] == consumer {
+			delete(g.revoking, partition)
+			released = true
+		}
+	}
+	if released {
+		h.applyAssignments(key)
+	}
+}
+
+func (h *CommandHandler) revoked(req *Request) error {
+	var revocation types.Revocation
+	err := req.Command.DecodeData(&revocation)
+	if err != nil {
+		return fmt.Errorf("%w: %w", types.BAD_REQUEST_ERROR, err)
+	}
+
+	consumer, ok := h.consumerOf(req.Conn)
+	if !ok {
+		return fmt.Errorf("%w: connection %d is not a consumer", types.BAD_REQUEST_ERROR, req.Conn.Id)
+	}
+
+	h.mutex.Lock()
+	h.release(groupKey{queueName: consumer.QueueName, group: consumer.Group}, consumer, revocation.Partitions)
+	h.mutex.Unlock()
+	return nil
+}
@@ -0,0 +1,92 @@
+package handler
+
+import (
+	"encoding"
+	"fmt"
+	"log/slog"
+
+	"github.com/playsthisgame/binq/types"
+)
+
+// HandlerFunc runs a command, the error it returns is sent back to the client
+// in a RESPONSE unless the handler already replied
+type HandlerFunc func(req *Request) error
+
+type Request struct {
+	Conn    *types.Connection
+	Command *types.TCPCommand
+	replied bool
+}
+
+// Reply answers the request, only the first reply is sent
+func (r *Request) Reply(err error) {
+	r.ReplyWith(nil, err)
+}
+
+// ReplyWith answers the request with the result of the command, the client
+// reads it with Response.Decode
+func (r *Request) ReplyWith(result encoding.BinaryMarshaler, err error) {
+	if r.replied {
+		return
+	}
+	r.replied = true
+	respond(r.Conn, r.Command, result, err)
+}
+
+// NoReply is for commands that are answered later, or only when they fail
+func (r *Request) NoReply() {
+	r.replied = true
+}
+
+type command struct {
+	name   string
+	handle HandlerFunc
+}
+
+// Register adds a custom command, custom opcodes start at types.CUSTOM_OPCODE
+// and can only be registered once
+func (h *CommandHandler) Register(op types.Opcode, name string, handle HandlerFunc) error {
+	if op < types.CUSTOM_OPCODE {
+		return fmt.Errorf("opcode %d is reserved, custom opcodes start at %d", op, types.CUSTOM_OPCODE)
+	}
+	return h.register(op, name, handle)
+}
+
+func (h *CommandHandler) register(op types.Opcode, name string, handle HandlerFunc) error {
+	if existing, ok := h.commands[op]; ok {
+		return fmt.Errorf("opcode %d is already registered to %s", op, existing.name)
+	}
+	h.commands[op] = command{name: name, handle: handle}
+	return nil
+}
+
+// respond tells the client how its request went, the response carries the
+// RequestId of the request so the client can match them up
+func respond(conn *types.Connection, cmd *types.TCPCommand, result encoding.BinaryMarshaler, err error) {
+	// legacy clients never read responses, they would take them for deliveries
+	if cmd.Version == types.LEGACY_VERSION {
+		return
+	}
+
+	response := types.NewResponse(err)
+	if result != nil {
+		data, mErr := result.MarshalBinary()
+		if mErr != nil {
+			slog.Error("error marshalling result", "error", mErr)
+			return
+		}
+		response.Data = data
+	}
+
+	res := conn.Reply(cmd, types.RESPONSE)
+	mErr := res.EncodeData(response)
+	if mErr != nil {
+		slog.Error("error marshalling response", "error", mErr)
+		return
+	}
+
+	wErr := conn.Write(res)
+	if wErr != nil {
+		slog.Error("error writing response", "id", conn.Id, "error", wErr)
+	}
+}
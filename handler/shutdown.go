@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/playsthisgame/binq/types"
+)
+
+// StopConsumers stops delivering messages, each consumer is sent a GOAWAY and
+// the messages leased to the connected consumers are released so they can be
+// received again as soon as the server is back
+func (h *CommandHandler) StopConsumers(ctx context.Context) error {
+	h.mutex.Lock()
+	if !h.stopping {
+		h.stopping = true
+		close(h.stop)
+	}
+	h.mutex.Unlock()
+
+	stopped := make(chan struct{})
+	go func() {
+		h.consumers.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	// the connections of every group, a nacked message holds no connection and
+	// keeps its delay
+	h.mutex.RLock()
+	connections := make(map[groupKey][]int, len(h.groups))
+	for key, g := range h.groups {
+		for _, consumer := range g.consumers {
+			connections[key] = append(connections[key], consumer.Conn.Id)
+		}
+	}
+	h.mutex.RUnlock()
+
+	for key, conns := range connections {
+		res := h.db.Model(&types.Delivery{}).
+			Where("queue_name = ? AND group_name = ? AND connection IN ? AND NOT acked AND lock_date_time > ?", key.queueName, key.group, conns, time.Now()).
+			Update("lock_date_time", nil)
+		if res.Error != nil {
+			slog.Error("Error releasing locks", "queue", key.queueName, "group", key.group, "error", res.Error)
+			return res.Error
+		}
+		slog.Debug("locks released", "queue", key.queueName, "group", key.group, "count", res.RowsAffected)
+	}
+	return nil
+}
+
+// Close stops the bodies still being fetched and closes the store once they
+// are done, nothing can be handled after it
+func (h *CommandHandler) Close() error {
+	h.streamMutex.Lock()
+	for key, f := range h.fetches {
+		delete(h.fetches, key)
+		close(f.done)
+	}
+	h.streamMutex.Unlock()
+	h.bodies.Wait()
+
+	sqlDB, err := h.db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
@@ -0,0 +1,350 @@
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/playsthisgame/binq/store"
+	"github.com/playsthisgame/binq/types"
+)
+
+// a body that is being published in chunks
+type stream struct {
+	message types.Message
+	file    *os.File
+}
+
+// the most chunks of a fetched body sent ahead of what the client read
+const maxFetchWindow = 64
+
+// errFetchStopped ends a fetch whose connection went away or gave up on it
+var errFetchStopped = errors.New("fetch stopped")
+
+// a body being sent to a client, every chunk takes a credit the client handed out
+type fetch struct {
+	credit chan struct{}
+	done   chan struct{} // closed when the fetch is stopped
+}
+
+// streams and fetches are identified by the connection and the RequestId of
+// the PUBLISH_STREAM or FETCH
+type streamKey struct {
+	connId    int
+	requestId uint32
+}
+
+// beginStream stores the message metadata and creates the blob the chunks are
+// written to
+func (h *CommandHandler) beginStream(cmd *types.TCPCommand, conn *types.Connection) error {
+	var msg types.Message
+	err := cmd.DecodeData(&msg)
+	if err != nil {
+		return fmt.Errorf("%w: error unmarshalling message", types.BAD_REQUEST_ERROR)
+	}
+
+	err = scheduleMessage(&msg)
+	if err != nil {
+		return err
+	}
+
+	// don't take the body of a message that can't be stored
+	queue, err := h.queues.get(msg.QueueName)
+	if err != nil {
+		return err
+	}
+	err = expireMessage(&msg, queue)
+	if err != nil {
+		return err
+	}
+
+	key := streamKey{connId: conn.Id, requestId: cmd.RequestId}
+	if _, ok := h.getStream(key, false); ok {
+		return fmt.Errorf("%w: stream %d already started", types.BAD_REQUEST_ERROR, cmd.RequestId)
+	}
+
+	file, err := store.CreateBlob()
+	if err != nil {
+		return fmt.Errorf("error creating blob for %s: %w", msg.QueueName, err)
+	}
+
+	// anything sent along with the metadata is the start of the body
+	_, err = file.Write(msg.Data)
+	if err != nil {
+		discardStream(&stream{file: file})
+		return fmt.Errorf("error writing blob for %s: %w", msg.QueueName, err)
+	}
+	msg.Data = nil
+
+	h.streamMutex.Lock()
+	h.streams[key] = &stream{message: msg, file: file}
+	h.streamMutex.Unlock()
+	return nil
+}
+
+// getStream looks up a stream, removing it when take is set. Only the map is
+// guarded, a stream is only ever used by the connection that started it
+func (h *CommandHandler) getStream(key streamKey, take bool) (*stream, bool) {
+	h.streamMutex.Lock()
+	defer h.streamMutex.Unlock()
+
+	s, ok := h.streams[key]
+	if ok && take {
+		delete(h.streams, key)
+	}
+	return s, ok
+}
+
+// writeChunk appends a chunk to its stream, a failed write drops the stream
+// and is reported to the client
+func (h *CommandHandler) writeChunk(cmd *types.TCPCommand, conn *types.Connection) error {
+	key := streamKey{connId: conn.Id, requestId: cmd.RequestId}
+	s, ok := h.getStream(key, false)
+	if !ok {
+		// the stream already failed and the client was told
+		return nil
+	}
+
+	_, err := s.file.Write(cmd.Data)
+	if err != nil {
+		h.getStream(key, true)
+		discardStream(s)
+		return fmt.Errorf("error writing blob for %s: %w", s.message.QueueName, err)
+	}
+	return nil
+}
+
+// endStream stores the message once the client has sent the whole body
+func (h *CommandHandler) endStream(cmd *types.TCPCommand, conn *types.Connection) (*types.PublishResult, error) {
+	key := streamKey{connId: conn.Id, requestId: cmd.RequestId}
+	s, ok := h.getStream(key, true)
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown stream %d", types.BAD_REQUEST_ERROR, cmd.RequestId)
+	}
+
+	var end types.Response
+	err := cmd.DecodeData(&end)
+	if err == nil {
+		err = end.Err()
+	}
+	if err != nil {
+		discardStream(s)
+		return nil, fmt.Errorf("stream abandoned by client: %w", err)
+	}
+
+	info, err := s.file.Stat()
+	if err == nil {
+		err = s.file.Close()
+	}
+	if err != nil {
+		discardStream(s)
+		return nil, fmt.Errorf("error closing blob for %s: %w", s.message.QueueName, err)
+	}
+
+	msg := s.message
+	msg.Streamed = true
+	msg.Size = info.Size()
+	msg.BlobName = filepath.Base(s.file.Name())
+	queue, err := h.queues.get(msg.QueueName)
+	if err != nil {
+		store.RemoveBlob(msg.BlobName)
+		return nil, err
+	}
+	assignPartition(&msg, queue)
+
+	result, err := storeMessage(&msg, queue, h.db)
+	if err != nil {
+		store.RemoveBlob(msg.BlobName)
+		return nil, fmt.Errorf("Error creating message for %s", msg.QueueName)
+	}
+	if result.Duplicate {
+		store.RemoveBlob(msg.BlobName)
+		slog.Info("Duplicate Streamed Message Dropped", "queue", msg.QueueName, "key", msg.MessageKey, "original", result.MessageId)
+		return result, nil
+	}
+	slog.Info("Streamed Message Created for Queue", "queue", msg.QueueName, "size", msg.Size)
+	h.published.notifyAt(msg.QueueName, msg.DeliverAt)
+	return result, nil
+}
+
+// dropStreams discards the streams of a connection that went away mid publish
+// and stops the bodies it was fetching
+func (h *CommandHandler) dropStreams(conn *types.Connection) {
+	h.streamMutex.Lock()
+	defer h.streamMutex.Unlock()
+
+	for key, s := range h.streams {
+		if key.connId == conn.Id {
+			delete(h.streams, key)
+			discardStream(s)
+		}
+	}
+	for key, f := range h.fetches {
+		if key.connId == conn.Id {
+			delete(h.fetches, key)
+			close(f.done)
+		}
+	}
+}
+
+// startFetch sets up the credit of a fetch, the client starts out with room
+// for window chunks
+func (h *CommandHandler) startFetch(key streamKey, window int) *fetch {
+	f := &fetch{credit: make(chan struct{}, window), done: make(chan struct{})}
+	for range window {
+		f.credit <- struct{}{}
+	}
+
+	h.streamMutex.Lock()
+	h.fetches[key] = f
+	h.streamMutex.Unlock()
+	return f
+}
+
+// grantFetch lets a fetch send count more chunks, credit over its window is
+// dropped
+func (h *CommandHandler) grantFetch(key streamKey, count int) {
+	h.streamMutex.Lock()
+	f, ok := h.fetches[key]
+	h.streamMutex.Unlock()
+	if !ok {
+		// the body was sent in full already
+		return
+	}
+
+	for range count {
+		select {
+		case f.credit <- struct{}{}:
+		default:
+			return
+		}
+	}
+}
+
+// stopFetch stops a fetch, it reports whether there was one
+func (h *CommandHandler) stopFetch(key streamKey) bool {
+	h.streamMutex.Lock()
+	defer h.streamMutex.Unlock()
+
+	f, ok := h.fetches[key]
+	if ok {
+		delete(h.fetches, key)
+		close(f.done)
+	}
+	return ok
+}
+
+func discardStream(s *stream) {
+	s.file.Close()
+	os.Remove(s.file.Name())
+}
+
+// fetchMessage checks the message can be streamed, the body itself is sent by
+// sendBody once the client has its response
+func fetchMessage(cmd *types.TCPCommand, conn *types.Connection, db *gorm.DB) (*types.Message, int, error) {
+	var req types.FetchRequest
+	err := cmd.DecodeData(&req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: %w", types.BAD_REQUEST_ERROR, err)
+	}
+	if req.Window <= 0 {
+		return nil, 0, fmt.Errorf("%w: fetch window %d is not positive", types.BAD_REQUEST_ERROR, req.Window)
+	}
+
+	// only the consumer the message is leased to can read its body
+	var leases int64
+	query := db.Model(&types.Delivery{}).
+		Where("message_id = ? AND connection = ? AND NOT acked AND lock_date_time > ?", req.MessageId, conn.Id, time.Now())
+	if req.Receipt != "" {
+		query = query.Where("receipt = ?", req.Receipt)
+	}
+	res := query.Count(&leases)
+	if res.Error != nil {
+		return nil, 0, fmt.Errorf("error finding lease of message %d: %w", req.MessageId, res.Error)
+	}
+	if leases == 0 {
+		return nil, 0, fmt.Errorf("%w: message %d is not leased to connection %d", types.BAD_REQUEST_ERROR, req.MessageId, conn.Id)
+	}
+
+	var msg types.Message
+	res = db.Limit(1).Find(&msg, req.MessageId)
+	if res.Error != nil {
+		return nil, 0, fmt.Errorf("error finding message %d: %w", req.MessageId, res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return nil, 0, fmt.Errorf("%w: message %d not found", types.BAD_REQUEST_ERROR, req.MessageId)
+	}
+	return &msg, min(req.Window, maxFetchWindow), nil
+}
+
+// sendBody streams the body of a message in CHUNK frames followed by a CHUNK_END,
+// as fast as the client hands out credit
+func (h *CommandHandler) sendBody(msg *types.Message, cmd *types.TCPCommand, conn *types.Connection, f *fetch) {
+	err := writeBody(msg, cmd, conn, f)
+	if errors.Is(err, errFetchStopped) {
+		return
+	}
+	h.stopFetch(streamKey{connId: conn.Id, requestId: cmd.RequestId})
+
+	end := conn.Reply(cmd, types.CHUNK_END)
+	mErr := end.EncodeData(types.NewResponse(err))
+	if mErr != nil {
+		slog.Error("error marshalling response", "error", mErr)
+		return
+	}
+
+	wErr := conn.Write(end)
+	if wErr != nil {
+		slog.Error("error writing stream end", "id", conn.Id, "error", wErr)
+	}
+}
+
+func writeBody(msg *types.Message, cmd *types.TCPCommand, conn *types.Connection, f *fetch) error {
+	var body io.Reader
+	if msg.Streamed {
+		file, err := store.OpenBlob(msg.BlobName)
+		if err != nil {
+			return fmt.Errorf("error opening blob for message %d: %w", msg.ID, err)
+		}
+		defer file.Close()
+		body = file
+	} else {
+		err := msg.Decompress()
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(msg.Data)
+	}
+
+	buf := make([]byte, types.STREAM_CHUNK_SIZE)
+	for {
+		n, err := io.ReadFull(body, buf)
+		if n > 0 {
+			select {
+			case <-f.credit:
+			case <-f.done:
+				return errFetchStopped
+			}
+
+			chunk := conn.Reply(cmd, types.CHUNK)
+			chunk.Data = buf[:n]
+			wErr := conn.Write(chunk)
+			if wErr != nil {
+				return wErr
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading blob for message %d: %w", msg.ID, err)
+		}
+	}
+}
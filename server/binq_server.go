@@ -1,24 +1,72 @@
 package server
 
 import (
+	"context"
 	"log/slog"
 	"os"
+	"runtime"
+	"sync"
+	"time"
 
 	"github.com/playsthisgame/binq/handler"
 	"github.com/playsthisgame/binq/store"
 	"github.com/playsthisgame/binq/tcp"
+	"github.com/playsthisgame/binq/types"
 )
 
 type Config struct {
 	Port          uint16
-	MaxPartitions int
+	MaxPartitions int // partitions of the queues that don't ask for their own, defaults to 100
 	CertPath      string
+
+	// queues are created the first time something is published to them or
+	// consumed from them, otherwise they have to be created first
+	AutoCreateQueues bool
+
+	// splits the partitions of a queue between the consumers of a group,
+	// defaults to types.StickyAssignor
+	Assignor types.Assignor
+
+	// a message that waited this long is received as if its priority was one
+	// higher, and so on, so low priorities aren't starved by a steady flow of
+	// higher ones. Defaults to a minute, priorities don't age when negative
+	PriorityAging time.Duration
+
+	// a consumer group that had no consumers for this long is dropped, the
+	// messages only it hadn't acked are removed. Defaults to a week, groups
+	// never expire when negative
+	GroupExpiry time.Duration
+
+	// frames over the threshold sent to clients that can read them are
+	// compressed with the codec, the threshold defaults to 1KiB
+	Compression       types.Codec
+	CompressThreshold int
+	// keep bodies that were published compressed compressed in the store
+	StoreCompressed bool
+
+	// clients are pinged every interval, 10s by default, and dropped after
+	// missing MissedHeartbeats in a row, 3 by default
+	HeartbeatInterval time.Duration
+	MissedHeartbeats  int
+
+	// how many connections have their commands handled at once, defaults to
+	// the number of CPUs. The commands of one connection are always handled in
+	// the order they were sent
+	Concurrency int
 }
 
 type BinqServer struct {
 	cmdHandler *handler.CommandHandler
 	server     *tcp.TCP
 	port       uint16
+	workers    int
+	done       chan struct{}  // closed when Shutdown starts
+	drained    chan struct{}  // closed when Listen has handled the last command
+	background sync.WaitGroup // the cleanup and expiry started by Listen, they stop once done is closed
+
+	// Shutdown can be called again, after its ctx ended for one
+	closeDone sync.Once
+	drain     sync.Once
 }
 
 func NewBinqServer(conf *Config) (*BinqServer, error) {
@@ -34,7 +82,18 @@ func NewBinqServer(conf *Config) (*BinqServer, error) {
 	if err != nil {
 		panic(err)
 	}
-	cmdHandler := handler.NewCommandHandler(db, &maxPartitions)
+	cmdHandler, err := handler.NewCommandHandler(db, &handler.Config{
+		MaxPartitions:    maxPartitions,
+		AutoCreateQueues: conf.AutoCreateQueues,
+		StoreCompressed:  conf.StoreCompressed,
+		Assignor:         conf.Assignor,
+		PriorityAging:    conf.PriorityAging,
+		GroupExpiry:      conf.GroupExpiry,
+	})
+	if err != nil {
+		slog.Error("Error setting up the command handler", "error", err)
+		return nil, err
+	}
 
 	// set up tcp server
 	var port uint16 = 3000
@@ -53,28 +112,118 @@ func NewBinqServer(conf *Config) (*BinqServer, error) {
 		return nil, err
 	}
 
+	server.Compression = conf.Compression
+	server.CompressThreshold = 1024
+	if conf.CompressThreshold != 0 {
+		server.CompressThreshold = conf.CompressThreshold
+	}
+	if conf.HeartbeatInterval != 0 {
+		server.HeartbeatInterval = conf.HeartbeatInterval
+	}
+	if conf.MissedHeartbeats != 0 {
+		server.MissedHeartbeats = conf.MissedHeartbeats
+	}
+
+	concurrency := runtime.NumCPU()
+	if conf.Concurrency != 0 {
+		concurrency = conf.Concurrency
+	}
+
 	return &BinqServer{
 		cmdHandler: cmdHandler,
 		server:     server,
 		port:       port,
+		workers:    concurrency,
+		done:       make(chan struct{}),
+		drained:    make(chan struct{}),
 	}, nil
 }
 
+// Listen handles commands until Shutdown is called
 func (b *BinqServer) Listen() {
+	defer close(b.drained)
 	defer b.server.Close()
 	go b.server.Start()
 	slog.Info("Binq started on", "port", b.port)
 
-	go store.ScheduleCleanup()
+	b.background.Add(3)
+	go func() {
+		defer b.background.Done()
+		store.ScheduleCleanup(b.done)
+	}()
+	go func() {
+		defer b.background.Done()
+		b.cmdHandler.ExpireMessages(b.done)
+	}()
+	go func() {
+		defer b.background.Done()
+		b.cmdHandler.ExpireGroups(b.done)
+	}()
 
-	for {
-		cmd := <-b.server.FromSockets
-		b.cmdHandler.Handle(&cmd)
+	// the commands of a connection are handled one at a time so they stay in
+	// order, at most b.workers connections have one handled at once
+	var wg sync.WaitGroup
+	workers := make(chan struct{}, b.workers)
+	for cmds := range b.server.FromSockets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for cmd := range cmds {
+				workers <- struct{}{}
+				b.cmdHandler.Handle(&cmd)
+				<-workers
+			}
+		}()
 	}
+	wg.Wait()
+}
+
+// Register adds a custom command, see handler.CommandHandler.Register. Commands
+// must be registered before Listen is called
+func (b *BinqServer) Register(op types.Opcode, name string, handle handler.HandlerFunc) error {
+	return b.cmdHandler.Register(op, name, handle)
 }
 
 func (b *BinqServer) Close() {
 	b.server.Close()
 }
 
+// Shutdown stops accepting connections and tells the consumers to stop, then
+// stops reading and handles whatever the connections already sent before
+// closing them and the store. If ctx ends first its error is returned and the store is left open
+func (b *BinqServer) Shutdown(ctx context.Context) error {
+	slog.Info("Binq shutting down")
+	b.closeDone.Do(func() { close(b.done) })
+	b.server.Close()
+
+	err := b.cmdHandler.StopConsumers(ctx)
+	if err != nil {
+		return err
+	}
+
+	b.drain.Do(func() { go b.server.Drain() })
+
+	select {
+	case <-b.drained:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	// everything read was answered, nothing is left to write
+	b.server.Shutdown()
+
+	stopped := make(chan struct{})
+	go func() {
+		b.background.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	slog.Info("Binq stopped")
+	return b.cmdHandler.Close()
+}
+
 // TODO: a func to return the number of available message
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/playsthisgame/binq/store"
+	"github.com/playsthisgame/binq/types"
+)
+
+// many consumers of one group claim the same partitions at once, every message
+// has to be claimed exactly once
+func main() {
+	os.Exit(run())
+}
+
+// run claims in a store of its own that is removed afterwards, it returns the
+// exit code
+func run() int {
+	dir, err := os.MkdirTemp("", "binq-claim-")
+	if err != nil {
+		slog.Error("Error creating temp dir", "error", err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+
+	wd, err := os.Getwd()
+	if err != nil {
+		slog.Error("Error getting working dir", "error", err)
+		return 1
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		slog.Error("Error changing to temp dir", "error", err)
+		return 1
+	}
+	defer os.Chdir(wd)
+
+	db, err := store.Setup()
+	if err != nil {
+		slog.Error("Error opening store", "error", err)
+		return 1
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		slog.Error("Error getting raw DB", "error", err)
+		return 1
+	}
+	defer sqlDB.Close()
+
+	const messageCount = 2000
+	const consumerCount = 20
+	const partitions = 4
+
+	queueName := fmt.Sprintf("claim_test_%d", time.Now().UnixNano())
+	msgs := make([]types.Message, messageCount)
+	for i := range msgs {
+		msgs[i] = types.Message{
+			QueueName: queueName,
+			Partition: i%partitions + 1,
+			Data:      []byte(fmt.Sprintf("message %d", i)),
+		}
+	}
+	res := db.CreateInBatches(msgs, 500)
+	if res.Error != nil {
+		slog.Error("Error creating messages", "error", res.Error)
+		return 1
+	}
+
+	var mutex sync.Mutex
+	claimedBy := make(map[uint]string, messageCount)
+	doubles := 0
+
+	var wg sync.WaitGroup
+	for c := 0; c < consumerCount; c++ {
+		consumer := fmt.Sprintf("consumer-%d", c)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				claimed, err := store.ClaimMessages(db, store.Claim{
+					QueueName:  queueName,
+					Group:      types.DEFAULT_CONSUMER_GROUP,
+					Consumer:   consumer,
+					Partitions: []int{1, 2, 3, 4},
+					Limit:      25,
+					Until:      time.Now().Add(time.Hour),
+				})
+				if err != nil {
+					slog.Error("Error claiming messages", "consumer", consumer, "error", err)
+					continue
+				}
+				if len(claimed) == 0 {
+					return
+				}
+
+				mutex.Lock()
+				for _, msg := range claimed {
+					if owner, ok := claimedBy[msg.ID]; ok {
+						slog.Error("message claimed twice", "id", msg.ID, "first", owner, "second", consumer)
+						doubles++
+					}
+					claimedBy[msg.ID] = consumer
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	slog.Info("claims finished", "messages", messageCount, "claimed", len(claimedBy), "claimed twice", doubles)
+	if doubles > 0 || len(claimedBy) != messageCount {
+		return 1
+	}
+	return 0
+}
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"context"
 	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/playsthisgame/binq/server"
 )
@@ -9,14 +14,29 @@ import (
 func main() {
 	binqServer, err := server.NewBinqServer(
 		&server.Config{
-			Port:          3000,
-			MaxPartitions: 100,
-			CertPath:      ".cert/",
+			Port:             3000,
+			MaxPartitions:    100,
+			CertPath:         ".cert/",
+			AutoCreateQueues: true,
 		},
 	)
 	if err != nil {
 		slog.Error("Error starting Binq Server", "Error", err)
+		os.Exit(1)
 	}
 
-	binqServer.Listen()
+	go binqServer.Listen()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+
+	// give in-flight commands a moment to finish
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	err = binqServer.Shutdown(ctx)
+	if err != nil {
+		slog.Error("Error shutting down Binq Server", "Error", err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,54 @@
+package store
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// streamed message bodies are too large for the messages table, they are
+// written to files here and the message keeps the BlobName
+const blobPath = ".store/blobs"
+
+// CreateBlob creates an empty file for a streamed body, the name of the file
+// is the BlobName to store on the message
+func CreateBlob() (*os.File, error) {
+	err := os.MkdirAll(blobPath, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	return os.CreateTemp(blobPath, "blob-*")
+}
+
+func OpenBlob(name string) (*os.File, error) {
+	return os.Open(filepath.Join(blobPath, filepath.Base(name)))
+}
+
+func RemoveBlob(name string) error {
+	return os.Remove(filepath.Join(blobPath, filepath.Base(name)))
+}
+
+// CopyBlob copies a streamed body for another message, it returns the name of
+// the copy
+func CopyBlob(name string) (string, error) {
+	src, err := OpenBlob(name)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	dst, err := CreateBlob()
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Close()
+	}
+	if err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+		return "", err
+	}
+	return filepath.Base(dst.Name()), nil
+}
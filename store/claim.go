@@ -0,0 +1,146 @@
+package store
+
+import (
+	"cmp"
+	"encoding/json"
+	"slices"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/playsthisgame/binq/types"
+)
+
+// Claim asks for a lease on the messages of a queue for one consumer of a group
+type Claim struct {
+	QueueName  string
+	Group      string
+	Consumer   string // recorded on the deliveries as the owner of the lease
+	Connection int    // the connection of the consumer, only it can ack what it was sent
+	Partitions []int
+	Limit      int // no limit when 0
+	Until      time.Time
+
+	// messages the group was sent this many times are left for the dead-letter
+	// queue, no limit when 0
+	MaxDeliveries int
+
+	// a message that waited this long since it was due is claimed as if its
+	// priority was one higher, and so on. Priorities don't age when 0
+	PriorityAging time.Duration
+}
+
+// ClaimMessages leases the messages of the partitions that the group hasn't
+// acked and nobody in it holds, leaving those that aren't due yet or expired.
+// The highest priorities go first, aged by how long they waited, and the
+// oldest first among the same priority. The messages are picked and locked by
+// a single statement, consumers claiming at the same time never get the same
+// one. Every message gets a new Receipt to ack it with, and the attempt is
+// added to the history of the delivery
+func ClaimMessages(db *gorm.DB, claim Claim) ([]types.Message, error) {
+	if len(claim.Partitions) == 0 {
+		return nil, nil
+	}
+
+	limit := claim.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+	now := time.Now()
+	aging := claim.PriorityAging.Seconds()
+
+	attempt, err := json.Marshal([]types.Attempt{{Consumer: claim.Consumer, DeliveredAt: now}})
+	if err != nil {
+		return nil, err
+	}
+
+	var leases []struct {
+		MessageID uint
+		Receipt   string
+		Attempts  int
+	}
+	res := db.Raw(
+		`INSERT INTO deliveries (message_id, group_name, queue_name, consumer, connection, receipt, lock_date_time, acked, attempts, history)
+		SELECT messages.id, ?, messages.queue_name, ?, ?, lower(hex(randomblob(16))), ?, false, 1, ? FROM messages
+		LEFT JOIN deliveries AS claimed ON claimed.message_id = messages.id AND claimed.group_name = ?
+		WHERE messages.queue_name = ? AND messages.partition IN ? AND messages.deleted_at IS NULL
+		AND (messages.deliver_at IS NULL OR messages.deliver_at <= ?)
+		AND (messages.expires_at IS NULL OR messages.expires_at > ?)
+		AND (claimed.message_id IS NULL OR (NOT claimed.acked AND (claimed.lock_date_time IS NULL OR claimed.lock_date_time <= ?) AND (? = 0 OR claimed.attempts < ?)))
+		ORDER BY messages.priority + CASE WHEN ? > 0 THEN CAST((julianday(?) - julianday(max(messages.created_at, coalesce(messages.deliver_at, '')))) * 86400 / ? AS INTEGER) ELSE 0 END DESC, messages.id
+		LIMIT ?
+		ON CONFLICT (message_id, group_name) DO UPDATE SET
+			consumer = excluded.consumer,
+			connection = excluded.connection,
+			receipt = excluded.receipt,
+			lock_date_time = excluded.lock_date_time,
+			attempts = deliveries.attempts + 1,
+			history = json_insert(coalesce(deliveries.history, '[]'), '$[#]', json_extract(excluded.history, '$[0]'))
+		WHERE NOT deliveries.acked AND (deliveries.lock_date_time IS NULL OR deliveries.lock_date_time <= ?)
+		RETURNING message_id, receipt, attempts`,
+		claim.Group,
+		claim.Consumer,
+		claim.Connection,
+		claim.Until,
+		string(attempt),
+		claim.Group,
+		claim.QueueName,
+		claim.Partitions,
+		now,
+		now,
+		now,
+		claim.MaxDeliveries,
+		claim.MaxDeliveries,
+		aging,
+		now,
+		aging,
+		limit,
+		now,
+	).Scan(&leases)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if len(leases) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]uint, len(leases))
+	byId := make(map[uint]int, len(leases))
+	for i, lease := range leases {
+		ids[i] = lease.MessageID
+		byId[lease.MessageID] = i
+	}
+
+	var msgs []types.Message
+	res = db.Find(&msgs, ids)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	for i := range msgs {
+		lease := leases[byId[msgs[i].ID]]
+		msgs[i].Receipt = lease.Receipt
+		msgs[i].Deliveries = lease.Attempts
+	}
+
+	// in the order they were claimed, RETURNING doesn't keep it
+	slices.SortFunc(msgs, func(a, b types.Message) int {
+		if c := cmp.Compare(agedPriority(&b, now, claim.PriorityAging), agedPriority(&a, now, claim.PriorityAging)); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return msgs, nil
+}
+
+// agedPriority is the priority a message is claimed with, as ClaimMessages
+// orders them
+func agedPriority(msg *types.Message, now time.Time, aging time.Duration) int {
+	if aging <= 0 {
+		return msg.Priority
+	}
+	due := msg.CreatedAt
+	if msg.DeliverAt.After(due) {
+		due = msg.DeliverAt
+	}
+	return msg.Priority + int(now.Sub(due)/aging)
+}
@@ -16,8 +16,9 @@ func Setup() (*gorm.DB, error) {
 	path := ".store"
 	_ = os.MkdirAll(path, os.ModePerm)
 
-	// init db
-	db, err := gorm.Open(sqlite.Open(".store/binq.db"), &gorm.Config{})
+	// init db, commands are handled concurrently so writers wait on each other
+	// instead of failing with SQLITE_BUSY
+	db, err := gorm.Open(sqlite.Open(".store/binq.db?_pragma=busy_timeout(5000)"), &gorm.Config{})
 	if err != nil {
 		slog.Error("Error initializing sqlite", "error", err)
 		return nil, err
@@ -36,16 +37,27 @@ func Setup() (*gorm.DB, error) {
 		slog.Error("Error setting WAL mode", "error", err)
 	}
 
+	// the locks moved to the deliveries of each group and lookups by queue and
+	// partition use idx_messages_queue_due now
+	if db.Migrator().HasIndex(&types.Message{}, "idx_messages_queue_partition_lock") {
+		db.Migrator().DropIndex(&types.Message{}, "idx_messages_queue_partition_lock")
+	}
+
 	// automigrate db
 	db.AutoMigrate(&types.Message{})
 	db.AutoMigrate(&types.Queue{})
+	db.AutoMigrate(&types.ConsumerGroup{})
+	db.AutoMigrate(&types.Delivery{})
+
+	// groups from before they were last seen start counting from now
+	db.Model(&types.ConsumerGroup{}).Where("last_seen IS NULL").Update("last_seen", time.Now())
 
 	return db, nil
 }
 
 // TODO: you should add a cleanup for records that have been in the queue for too long, make it configurable
-// Schedule a cleanup of deleted records every day at midnight
-func ScheduleCleanup() {
+// Schedule a cleanup of deleted records every day at midnight, until done is closed
+func ScheduleCleanup(done <-chan struct{}) {
 	for {
 		now := time.Now()
 		next := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
@@ -56,7 +68,11 @@ func ScheduleCleanup() {
 		}
 
 		duration := next.Sub(now)
-		time.Sleep(duration)
+		select {
+		case <-done:
+			return
+		case <-time.After(duration):
+		}
 
 		performCleanup()
 	}
@@ -75,10 +91,46 @@ func performCleanup() {
 
 	slog.Info("Starting cleanup", "time", time.Now())
 
+	now := time.Now()
+	cutoff := now.AddDate(0, 0, -1)
+
+	// queues that remember keys for longer than a day keep their keyed
+	// messages until the window passed, or the key could be published again
+	var dedupQueues []types.Queue
+	db.Where("dedup_window > ?", now.Sub(cutoff)).Find(&dedupQueues)
+	expired := func() *gorm.DB {
+		tx := db.Unscoped().Model(&types.Message{}).Where("deleted_at < ?", cutoff)
+		for _, queue := range dedupQueues {
+			tx = tx.Where(
+				"NOT (queue_name = ? AND message_key != '' AND created_at > ?)",
+				queue.Name,
+				now.Add(-queue.DedupWindow),
+			)
+		}
+		return tx
+	}
+
+	// remove the bodies of streamed messages before their records go
+	var blobNames []string
+	expired().
+		Where("blob_name != ''").
+		Pluck("blob_name", &blobNames)
+	for _, name := range blobNames {
+		err := RemoveBlob(name)
+		if err != nil && !os.IsNotExist(err) {
+			slog.Error("Error removing blob", "name", name, "error", err)
+		}
+	}
+
+	// and what each consumer group did with them
+	result := db.Where("message_id IN (?)", expired().Select("id")).Delete(&types.Delivery{})
+	if result.Error != nil {
+		slog.Error("Error during cleanup", "Error", result.Error)
+		return
+	}
+
 	// Delete records older than 1 day
-	result := db.Unscoped().
-		Where("deleted_at < ?", time.Now().AddDate(0, 0, -1)).
-		Delete(&types.Message{})
+	result = db.Where("id IN (?)", expired().Select("id")).Unscoped().Delete(&types.Message{})
 
 	if result.Error != nil {
 		slog.Error("Error during cleanup", "Error", result.Error)
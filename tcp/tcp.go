@@ -7,10 +7,12 @@ import (
 	"io"
 	"log/slog"
 	"net"
+	"os"
 	"path/filepath"
 	"slices"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/playsthisgame/binq/cert"
 	"github.com/playsthisgame/binq/types"
@@ -21,8 +23,22 @@ type TCP struct {
 	sockets     []types.Connection
 	listener    net.Listener
 	mutex       sync.RWMutex
-	FromSockets chan types.TCPCommandWrapper
+	FromSockets chan (<-chan types.TCPCommandWrapper) // the commands of each connection, see readConnection
 	NewSocket   chan *types.Connection
+	Features    types.Feature // offered to clients in the HELLO
+
+	// used for frames written to clients that agreed on compression
+	Compression       types.Codec
+	CompressThreshold int
+
+	// clients that agreed on heartbeats are pinged every interval and dropped
+	// after missing MissedHeartbeats of them
+	HeartbeatInterval time.Duration
+	MissedHeartbeats  int
+
+	closing  bool
+	draining bool           // nothing more is read, see Drain
+	readers  sync.WaitGroup // one for every readConnection
 }
 
 func (t *TCP) ConnectionCount() int {
@@ -57,10 +73,43 @@ func (t *TCP) Send(command *types.TCPCommand) {
 	}
 }
 
+// Close stops accepting connections, the ones already open are left alone
 func (t *TCP) Close() {
+	t.mutex.Lock()
+	t.closing = true
+	t.mutex.Unlock()
 	t.listener.Close()
 }
 
+// Drain stops accepting connections and reading from the open ones,
+// FromSockets is closed once the last command read from them has been sent.
+// The connections stay open so those commands can still be answered
+func (t *TCP) Drain() {
+	t.Close()
+
+	t.mutex.Lock()
+	t.draining = true
+	for i := range t.sockets {
+		t.sockets[i].SetReadDeadline(time.Now())
+	}
+	t.mutex.Unlock()
+
+	t.readers.Wait()
+	close(t.FromSockets)
+}
+
+// Shutdown stops accepting connections and closes the open ones, call Drain
+// first for the commands already read to be answered
+func (t *TCP) Shutdown() {
+	t.Close()
+
+	t.mutex.RLock()
+	for i := range t.sockets {
+		t.sockets[i].Close()
+	}
+	t.mutex.RUnlock()
+}
+
 func NewTCPServer(port uint16, certPath string) (*TCP, error) {
 	err := cert.Setup(certPath)
 	if err != nil {
@@ -79,35 +128,160 @@ func NewTCPServer(port uint16, certPath string) (*TCP, error) {
 
 	// TODO: Done channel
 	return &TCP{
-		sockets:     make([]types.Connection, 0, 100),
-		listener:    listener,
-		FromSockets: make(chan types.TCPCommandWrapper, 100),
-		mutex:       sync.RWMutex{},
+		sockets:           make([]types.Connection, 0, 100),
+		listener:          listener,
+		FromSockets:       make(chan (<-chan types.TCPCommandWrapper), 100),
+		mutex:             sync.RWMutex{},
+		Features:          types.FEATURE_STREAMING | types.FEATURE_COMPRESSION | types.FEATURE_HEARTBEAT | types.FEATURE_CHECKSUM,
+		HeartbeatInterval: 10 * time.Second,
+		MissedHeartbeats:  3,
 	}, nil
 }
 
+// readConnection sends the commands of a connection on a channel of its own, in
+// the order they were read. A connection whose commands aren't taken fast
+// enough stops being read without holding up the others
 func readConnection(tcp *TCP, conn *types.Connection) {
+	defer tcp.readers.Done()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	cmds := make(chan types.TCPCommandWrapper, 100)
+	defer close(cmds)
+	tcp.FromSockets <- cmds
+
 	for {
+		// under the lock so a deadline set here can't push back the one Drain set
+		tcp.mutex.RLock()
+		draining := tcp.draining
+		if !draining && conn.Features.Has(types.FEATURE_HEARTBEAT) {
+			conn.SetReadDeadline(time.Now().Add(tcp.HeartbeatInterval * time.Duration(tcp.MissedHeartbeats)))
+		}
+		tcp.mutex.RUnlock()
+		if draining {
+			slog.Debug("socket drained", "id", conn.Id)
+			cmds <- types.TCPCommandWrapper{Conn: conn, Disconnected: true}
+			break
+		}
+
 		cmd, err := conn.Next() // once you have the command you can do whatever youd like with the data
+		if err != nil && tcp.isDraining() {
+			// the connection stays open until Shutdown, only reading it is over
+			slog.Debug("socket drained", "id", conn.Id)
+			cmds <- types.TCPCommandWrapper{Conn: conn, Disconnected: true}
+			break
+		}
 		if err != nil {
 			if errors.Is(err, io.EOF) {
 				slog.Debug("socket received EOF", "id", conn.Id, "error", err)
+			} else if errors.Is(err, net.ErrClosed) {
+				slog.Debug("socket closed", "id", conn.Id)
+			} else if errors.Is(err, os.ErrDeadlineExceeded) {
+				slog.Info("socket missed heartbeats", "id", conn.Id, "missed", tcp.MissedHeartbeats)
+			} else if errors.Is(err, types.PROTOCOL_ERROR) {
+				slog.Warn("socket sent a bad frame", "id", conn.Id, "error", err)
+				protocolError(conn, err)
 			} else {
 				slog.Error("received error while reading from socket", "id", conn.Id, "error", err)
 			}
+			// nothing more can be read, make sure nothing more is written either
+			conn.Close()
 			// remove from sockets
+			tcp.mutex.Lock()
 			for i := len(tcp.sockets) - 1; i >= 0; i-- {
 				if tcp.sockets[i].Id == conn.Id {
 					tcp.sockets = slices.Delete(tcp.sockets, i, i+1)
 					break
 				}
 			}
-			// TODO: send a drop command to remove the socket from the consumers if its a consumer socket
-			tcp.FromSockets <- types.TCPCommandWrapper{Command: &types.TCPCommand{Command: 5}, Conn: conn}
+			tcp.mutex.Unlock()
+			// let the handler drop whatever the connection had going
+			cmds <- types.TCPCommandWrapper{Conn: conn, Disconnected: true}
 			break
 		}
 
-		tcp.FromSockets <- types.TCPCommandWrapper{Command: cmd, Conn: conn}
+		// the handshake and heartbeats belong to the connection, the handler never sees them
+		switch cmd.Command {
+		case types.HELLO:
+			err = hello(tcp, conn, cmd)
+			if err != nil {
+				slog.Error("handshake failed", "id", conn.Id, "error", err)
+				// the next read fails and the connection is dropped as usual
+				conn.Close()
+			} else if conn.Features.Has(types.FEATURE_HEARTBEAT) {
+				go conn.Heartbeat(tcp.HeartbeatInterval, done)
+			}
+			continue
+		case types.PING:
+			err = conn.Pong(cmd)
+			if err != nil {
+				slog.Debug("error answering ping", "id", conn.Id, "error", err)
+			}
+			continue
+		case types.PONG:
+			// reading it was enough to push the deadline back
+			continue
+		}
+
+		cmds <- types.TCPCommandWrapper{Command: cmd, Conn: conn}
+	}
+}
+
+func (tcp *TCP) isDraining() bool {
+	tcp.mutex.RLock()
+	defer tcp.mutex.RUnlock()
+	return tcp.draining
+}
+
+// hello agrees on the version and features for the connection, everything
+// read and written after it uses them
+func hello(tcp *TCP, conn *types.Connection, cmd *types.TCPCommand) error {
+	var req types.Hello
+	err := req.UnmarshalBinary(cmd.Data)
+	if err == nil && conn.Version != 0 {
+		err = errors.New("connection already said hello")
+	}
+
+	var res *types.Hello
+	if err == nil {
+		res, err = req.Negotiate(types.SUPPORTED_VERSIONS, tcp.Features)
+	}
+
+	if err != nil {
+		reply := conn.Reply(cmd, types.RESPONSE)
+		mErr := reply.EncodeData(types.NewResponse(fmt.Errorf("%w: %w", types.BAD_REQUEST_ERROR, err)))
+		if mErr == nil {
+			conn.Writer.Write(reply)
+		}
+		return err
+	}
+
+	conn.Version = res.Versions[0]
+	conn.Features = res.Features
+	conn.Compression = tcp.Compression
+	conn.CompressThreshold = tcp.CompressThreshold
+
+	reply := conn.Reply(cmd, types.HELLO)
+	reply.Data, err = res.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	slog.Debug("handshake", "id", conn.Id, "version", conn.Version, "features", conn.Features)
+	return conn.Writer.Write(reply)
+}
+
+// protocolError tells the client why it is about to be dropped, the frame can't
+// be trusted so it isn't tied to any request
+func protocolError(conn *types.Connection, err error) {
+	reply := conn.NewCommand(types.RESPONSE, 0)
+	mErr := reply.EncodeData(types.NewResponse(err))
+	if mErr == nil {
+		mErr = conn.Write(reply)
+	}
+	if mErr != nil {
+		slog.Debug("error sending protocol error", "id", conn.Id, "error", mErr)
 	}
 }
 
@@ -116,8 +290,12 @@ func (tcp *TCP) Start() {
 	for {
 		conn, err := tcp.listener.Accept()
 		if err != nil {
-			// if the listener is closed then this will log as an error
-			slog.Error("server error:", "error", err)
+			tcp.mutex.RLock()
+			closing := tcp.closing
+			tcp.mutex.RUnlock()
+			if !closing {
+				slog.Error("server error:", "error", err)
+			}
 			break
 		}
 		id++
@@ -126,7 +304,14 @@ func (tcp *TCP) Start() {
 		slog.Info("new connection", "id", newConn.Id, "connHash", newConn.ConnHash)
 
 		tcp.mutex.Lock()
+		if tcp.closing {
+			// accepted just before the listener closed
+			tcp.mutex.Unlock()
+			conn.Close()
+			break
+		}
 		tcp.sockets = append(tcp.sockets, newConn)
+		tcp.readers.Add(1)
 		tcp.mutex.Unlock()
 
 		go readConnection(tcp, &newConn)
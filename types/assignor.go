@@ -0,0 +1,186 @@
+package types
+
+import (
+	"cmp"
+	"hash/fnv"
+	"slices"
+	"sort"
+	"strconv"
+)
+
+// Assignor splits the partitions of a queue between the consumers of a group
+type Assignor interface {
+	// Assign returns the partitions, 1 to partitions, of every member. Current
+	// is what the members were given by the last Assign and has nothing for
+	// members that just joined
+	Assign(members []string, partitions int, current map[string][]int) map[string][]int
+}
+
+// RangeAssignor gives every member a run of neighbouring partitions
+type RangeAssignor struct{}
+
+func (RangeAssignor) Assign(members []string, partitions int, current map[string][]int) map[string][]int {
+	members = sorted(members)
+	assigned := make(map[string][]int, len(members))
+	if len(members) == 0 {
+		return assigned
+	}
+
+	size, extra := partitions/len(members), partitions%len(members)
+	next := 1
+	for i, member := range members {
+		n := size
+		if i < extra {
+			n++
+		}
+		for p := next; p < next+n; p++ {
+			assigned[member] = append(assigned[member], p)
+		}
+		next += n
+	}
+	return assigned
+}
+
+// RoundRobinAssignor deals the partitions out to the members one at a time
+type RoundRobinAssignor struct{}
+
+func (RoundRobinAssignor) Assign(members []string, partitions int, current map[string][]int) map[string][]int {
+	members = sorted(members)
+	assigned := make(map[string][]int, len(members))
+	if len(members) == 0 {
+		return assigned
+	}
+
+	for p := 1; p <= partitions; p++ {
+		member := members[(p-1)%len(members)]
+		assigned[member] = append(assigned[member], p)
+	}
+	return assigned
+}
+
+// StickyAssignor keeps the balance of RoundRobinAssignor but leaves members
+// with what they already have, only the partitions that have to move do
+type StickyAssignor struct{}
+
+func (StickyAssignor) Assign(members []string, partitions int, current map[string][]int) map[string][]int {
+	members = sorted(members)
+	assigned := make(map[string][]int, len(members))
+	if len(members) == 0 {
+		return assigned
+	}
+
+	// every member ends up with size partitions, extra of them with one more
+	size, extra := partitions/len(members), partitions%len(members)
+
+	// members holding the most keep the most, so as little as possible moves
+	keepers := slices.Clone(members)
+	sort.SliceStable(keepers, func(i, j int) bool {
+		return len(current[keepers[i]]) > len(current[keepers[j]])
+	})
+
+	taken := make(map[int]bool, partitions)
+	for _, member := range keepers {
+		held := sorted(current[member])
+		limit := size
+		if extra > 0 && len(held) > size {
+			limit++
+			extra--
+		}
+		for _, p := range held {
+			if len(assigned[member]) == limit {
+				break
+			}
+			if p >= 1 && p <= partitions && !taken[p] {
+				taken[p] = true
+				assigned[member] = append(assigned[member], p)
+			}
+		}
+	}
+
+	// the rest go to whoever has the fewest
+	for p := 1; p <= partitions; p++ {
+		if taken[p] {
+			continue
+		}
+		least := members[0]
+		for _, member := range members[1:] {
+			if len(assigned[member]) < len(assigned[least]) {
+				least = member
+			}
+		}
+		assigned[least] = append(assigned[least], p)
+	}
+
+	for member := range assigned {
+		slices.Sort(assigned[member])
+	}
+	return assigned
+}
+
+// ConsistentHashAssignor places the members and the partitions on a hash ring,
+// a partition belongs to the first member after it. Members joining or
+// leaving only move the partitions next to them, it doesn't balance as evenly
+// as the others
+type ConsistentHashAssignor struct {
+	Replicas int // points on the ring for every member, defaults to 100
+}
+
+func (a ConsistentHashAssignor) Assign(members []string, partitions int, current map[string][]int) map[string][]int {
+	assigned := make(map[string][]int, len(members))
+	if len(members) == 0 {
+		return assigned
+	}
+
+	replicas := a.Replicas
+	if replicas <= 0 {
+		replicas = 100
+	}
+
+	type point struct {
+		hash   uint32
+		member string
+	}
+	ring := make([]point, 0, len(members)*replicas)
+	for _, member := range members {
+		for i := 0; i < replicas; i++ {
+			ring = append(ring, point{hash: ringHash(member + "#" + strconv.Itoa(i)), member: member})
+		}
+	}
+	slices.SortFunc(ring, func(a, b point) int {
+		if a.hash != b.hash {
+			return cmp.Compare(a.hash, b.hash)
+		}
+		return cmp.Compare(a.member, b.member)
+	})
+
+	for p := 1; p <= partitions; p++ {
+		hash := ringHash(strconv.Itoa(p))
+		i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= hash })
+		if i == len(ring) {
+			i = 0
+		}
+		member := ring[i].member
+		assigned[member] = append(assigned[member], p)
+	}
+	return assigned
+}
+
+func sorted[T cmp.Ordered](s []T) []T {
+	s = slices.Clone(s)
+	slices.Sort(s)
+	return s
+}
+
+// ringHash is fnv with the murmur3 finalizer, fnv alone leaves keys that only
+// differ in their last byte next to each other on the ring
+func ringHash(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	hash := h.Sum32()
+	hash ^= hash >> 16
+	hash *= 0x85ebca6b
+	hash ^= hash >> 13
+	hash *= 0xc2b2ae35
+	hash ^= hash >> 16
+	return hash
+}
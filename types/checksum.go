@@ -0,0 +1,22 @@
+package types
+
+import (
+	"errors"
+	"hash/crc32"
+)
+
+// frames with this flag end in a CRC32C of the header and Data, the trailer is
+// not counted in the length
+const FLAG_CHECKSUM byte = 0x04
+
+const CHECKSUM_SIZE = 4
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// anything wrong with a frame itself rather than with the request it carries,
+// the connection can't be trusted after one
+var PROTOCOL_ERROR = errors.New("protocol error")
+
+func checksum(data []byte) uint32 {
+	return crc32.Checksum(data, crc32c)
+}
@@ -0,0 +1,99 @@
+package types
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec is how the Data of a frame, or the body of a stored message, is compressed
+type Codec byte
+
+const (
+	CODEC_NONE Codec = iota
+	CODEC_GZIP
+	CODEC_ZSTD
+	CODEC_SNAPPY
+)
+
+// the low bits of the frame flags hold the Codec of the frame's Data
+const FLAG_CODEC byte = 0x03
+
+func (c Codec) String() string {
+	switch c {
+	case CODEC_NONE:
+		return "none"
+	case CODEC_GZIP:
+		return "gzip"
+	case CODEC_ZSTD:
+		return "zstd"
+	case CODEC_SNAPPY:
+		return "snappy"
+	default:
+		return fmt.Sprintf("codec(%d)", byte(c))
+	}
+}
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(MAX_PACKET_LENGTH))
+)
+
+func Compress(codec Codec, data []byte) ([]byte, error) {
+	switch codec {
+	case CODEC_NONE:
+		return data, nil
+	case CODEC_GZIP:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		_, err := w.Write(data)
+		if err == nil {
+			err = w.Close()
+		}
+		return buf.Bytes(), err
+	case CODEC_ZSTD:
+		return zstdEncoder.EncodeAll(data, nil), nil
+	case CODEC_SNAPPY:
+		return snappy.Encode(nil, data), nil
+	default:
+		return nil, fmt.Errorf("unknown codec %d", codec)
+	}
+}
+
+// Decompress refuses anything that would grow past MAX_PACKET_LENGTH
+func Decompress(codec Codec, data []byte) ([]byte, error) {
+	switch codec {
+	case CODEC_NONE:
+		return data, nil
+	case CODEC_GZIP:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		out, err := io.ReadAll(io.LimitReader(r, MAX_PACKET_LENGTH+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(out) > MAX_PACKET_LENGTH {
+			return nil, fmt.Errorf("Decompress %w", MAX_PACKET_ERROR)
+		}
+		return out, nil
+	case CODEC_ZSTD:
+		return zstdDecoder.DecodeAll(data, nil)
+	case CODEC_SNAPPY:
+		n, err := snappy.DecodedLen(data)
+		if err != nil {
+			return nil, err
+		}
+		if n > MAX_PACKET_LENGTH {
+			return nil, fmt.Errorf("Decompress %w", MAX_PACKET_ERROR)
+		}
+		return snappy.Decode(nil, data)
+	default:
+		return nil, fmt.Errorf("unknown codec %d", codec)
+	}
+}
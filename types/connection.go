@@ -7,15 +7,17 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/playsthisgame/binq/utils"
 )
 
 var id int = 0
 
-// const MAX_PACKET_LENGTH = 10_000
-// max size for uint32
-const MAX_PACKET_LENGTH = 4294967295 // TODO: stream this data
+// the largest frame a reader will buffer, bigger bodies are streamed in
+// STREAM_CHUNK_SIZE pieces with PUBLISH_STREAM
+const MAX_PACKET_LENGTH = 64 << 20
 
 var MAX_PACKET_ERROR = errors.New("maximum packet size exceeded")
 
@@ -26,6 +28,20 @@ type Connection struct {
 	conn     net.Conn
 	ConnHash string
 
+	// agreed in the HELLO, a Version of 0 means the connection never said
+	// hello and every frame is read in the version it was written in
+	Version  byte
+	Features Feature
+	// the connection never said hello and sent a LEGACY_VERSION frame, what
+	// the server starts is written in that layout too. Set like Version before
+	// the frame is handed on
+	legacy bool
+
+	// frames with more Data than the threshold are compressed with the codec
+	// when the connection agreed on FEATURE_COMPRESSION
+	Compression       Codec
+	CompressThreshold int
+
 	previous []byte
 	scratch  [1024]byte
 }
@@ -45,6 +61,10 @@ func (c *Connection) Close() {
 	c.conn.Close()
 }
 
+func (c *Connection) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
 func (c *Connection) Next() (*TCPCommand, error) {
 	cmdBytes, err := c.Reader.Read()
 	if err != nil {
@@ -57,9 +77,80 @@ func (c *Connection) Next() (*TCPCommand, error) {
 		return nil, err
 	}
 
+	if c.Version != 0 && cmd.Version != c.Version {
+		return nil, fmt.Errorf("%w: version mismatch %d != negotiated %d", PROTOCOL_ERROR, cmd.Version, c.Version)
+	}
+	if c.Version == 0 && !c.legacy && cmd.Version == LEGACY_VERSION {
+		c.legacy = true
+	}
+
+	if cmd.Codec() != CODEC_NONE {
+		cmd.Data, err = Decompress(cmd.Codec(), cmd.Data)
+		if err != nil {
+			return nil, fmt.Errorf("%w: error decompressing %s frame: %w", PROTOCOL_ERROR, cmd.Codec(), err)
+		}
+	}
+
 	return &cmd, nil
 }
 
+// Write sends a frame, compressing its Data when the connection agreed on
+// compression and the Data is over the threshold, and adding a checksum when
+// the connection agreed on checksums
+func (c *Connection) Write(cmd *TCPCommand) error {
+	out := *cmd
+
+	if c.Compression != CODEC_NONE &&
+		c.Features.Has(FEATURE_COMPRESSION) &&
+		out.Codec() == CODEC_NONE &&
+		len(out.Data) > c.CompressThreshold {
+		data, err := Compress(c.Compression, out.Data)
+		if err != nil {
+			return err
+		}
+
+		// only worth sending when it actually got smaller
+		if len(data) < len(out.Data) {
+			out.Flags |= byte(c.Compression)
+			out.Data = data
+		}
+	}
+
+	if c.Features.Has(FEATURE_CHECKSUM) {
+		out.Flags |= FLAG_CHECKSUM
+	}
+
+	return c.Writer.Write(&out)
+}
+
+// NewCommand starts a frame in the negotiated version, VERSION when the
+// connection never negotiated one unless it is a legacy client
+func (c *Connection) NewCommand(command Opcode, requestId uint32) *TCPCommand {
+	version := c.Version
+	if version == 0 && !c.legacy {
+		version = VERSION
+	}
+	return &TCPCommand{
+		Version:   version,
+		Command:   command,
+		RequestId: requestId,
+	}
+}
+
+// Reply starts a frame answering req, in the negotiated version or the version
+// of req when the connection never negotiated one
+func (c *Connection) Reply(req *TCPCommand, command Opcode) *TCPCommand {
+	version := c.Version
+	if version == 0 {
+		version = req.Version
+	}
+	return &TCPCommand{
+		Version:   version,
+		Command:   command,
+		RequestId: req.RequestId,
+	}
+}
+
 type FrameReader struct {
 	Reader   io.Reader
 	previous []byte
@@ -75,27 +166,38 @@ func NewFrameReader(Reader io.Reader) FrameReader {
 }
 
 func (f *FrameReader) canParse(data []byte) bool {
-	if len(data) < HEADER_SIZE {
-		return false
-	}
-
-	length := int(binary.BigEndian.Uint32(data[2:]))
-	return len(data) >= HEADER_SIZE+length
+	n := f.packetLen(data)
+	return n >= 0 && len(data) >= n
 }
 
 func (f *FrameReader) packetLen(data []byte) int {
-	if len(data) < HEADER_SIZE {
+	if len(data) == 0 {
+		return -1
+	}
+
+	headerSize, lengthOffset := headerLayout(data[0])
+	if len(data) < headerSize {
 		return -1
 	}
 
-	return int(binary.BigEndian.Uint32(data[2:])) + HEADER_SIZE
+	trailer := 0
+	if headerSize == HEADER_SIZE && data[2]&FLAG_CHECKSUM != 0 {
+		trailer = CHECKSUM_SIZE
+	}
+
+	return int(binary.BigEndian.Uint32(data[lengthOffset:])) + headerSize + trailer
 }
 
 func (f *FrameReader) Read() ([]byte, error) {
 	for {
+		// don't wait on a length from a header that can't be read
+		if len(f.previous) > 0 && !readable(f.previous[0]) {
+			return nil, fmt.Errorf("%w: FrameReader#Read unknown version %d", PROTOCOL_ERROR, f.previous[0])
+		}
+
 		n := f.packetLen(f.previous)
 		if n > MAX_PACKET_LENGTH {
-			return nil, fmt.Errorf("FrameReader#Read %d %w", n, MAX_PACKET_ERROR)
+			return nil, fmt.Errorf("%w: FrameReader#Read %d %w", PROTOCOL_ERROR, n, MAX_PACKET_ERROR)
 		}
 
 		if f.canParse(f.previous) {
@@ -122,11 +224,13 @@ type Bytes interface {
 
 type FrameWriter struct {
 	Writer io.Writer
+	mutex  *sync.Mutex // shared by copies so that frames from different goroutines never interleave
 }
 
 func NewFrameWriter(Writer io.Writer) FrameWriter {
 	return FrameWriter{
 		Writer: Writer,
+		mutex:  &sync.Mutex{},
 	}
 }
 
@@ -136,6 +240,9 @@ func (w *FrameWriter) Write(bytes encoding.BinaryMarshaler) error {
 		return err
 	}
 
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
 	length := len(data)
 
 	for length > 0 {
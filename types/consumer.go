@@ -2,65 +2,209 @@ package types
 
 import (
 	"encoding/json"
-	"errors"
-	"fmt"
+	"sync"
+	"time"
 )
 
 type ConsumerSocket struct {
-	Instance   int
-	Partitions []int
+	Id         string // names the consumer in its group while it is connected
+	Partitions []int  // read with Assigned, the consumer's messages are being sent while it is rebalanced
 	Conn       Connection
 	QueueName  string
+	Group      string
+	mutex      sync.RWMutex
+
+	// held while a batch is read and written, a REVOKE is only written between
+	// batches so nothing from a revoked partition follows it
+	Sending sync.Mutex
+
+	done      chan struct{} // closed by Close
+	closeOnce sync.Once
 }
 
-func NewConsumerSocket(
-	instance int,
-	totalInstances int,
-	maxPartitions int,
-	queueName string,
-	conn Connection,
-) (*ConsumerSocket, error) {
-	if totalInstances > maxPartitions {
-		return nil, errors.New(
-			fmt.Sprintf(
-				"number of instances %d cannot exceed maxPartitions %d \n",
-				instance,
-				maxPartitions,
-			),
-		)
-	}
+// NewConsumerSocket makes a consumer without partitions, the group assigns
+// them. There can be more consumers than partitions, the ones left over wait
+// until a partition is free
+func NewConsumerSocket(id string, queueName string, group string, conn Connection) *ConsumerSocket {
 	return &ConsumerSocket{
-		Instance:   instance,
-		Conn:       conn,
-		Partitions: SetPartitions(instance, totalInstances, maxPartitions),
-		QueueName:  queueName,
-	}, nil
-}
-
-// TODO: this method seems to be wrong, when ousting
-func SetPartitions(instance int, totalInstances int, maxPartitions int) []int {
-	partitions := []int{}
-	for i := instance; i <= maxPartitions; i += totalInstances {
-		partitions = append(partitions, i)
+		Id:        id,
+		Conn:      conn,
+		QueueName: queueName,
+		Group:     group,
+		done:      make(chan struct{}),
 	}
-	return partitions
+}
+
+// Close tells whatever is sending to the consumer that it is gone, it can be
+// called more than once
+func (c *ConsumerSocket) Close() {
+	c.closeOnce.Do(func() { close(c.done) })
+}
+
+// Done is closed once the consumer is gone
+func (c *ConsumerSocket) Done() <-chan struct{} {
+	return c.done
+}
+
+// Assign sets the partitions the consumer receives from
+func (c *ConsumerSocket) Assign(partitions []int) {
+	c.mutex.Lock()
+	c.Partitions = partitions
+	c.mutex.Unlock()
+}
+
+// Assigned returns the partitions the consumer receives from
+func (c *ConsumerSocket) Assigned() []int {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.Partitions
 }
 
 type ConsumerRequest struct {
 	QueueName string
 	BatchSize int
+	// consumers in the same group split the messages of the queue between
+	// them, every group gets all of them. Defaults to DEFAULT_CONSUMER_GROUP
+	Group string
+	// names the consumer in its group, defaults to the connection id. The
+	// partitions of a consumer that disconnects go to the others, it starts
+	// over when it reconnects
+	ConsumerId string
+
+	// how long the server waits for a message before looking again, it also
+	// looks as soon as something is published. Defaults to 20s
+	WaitTime time.Duration
+	// send an empty batch every time the wait is over and nothing came
+	EmptyBatches bool
+
+	// the most messages the consumer holds without acking them, no limit when 0
+	Prefetch int
+	// acks don't make room, the server sends Prefetch messages and then only as
+	// many as the consumer grants with CREDIT
+	ManualCredit bool
 }
 
+const (
+	consumerRequestTagQueueName byte = iota + 1
+	consumerRequestTagBatchSize
+	consumerRequestTagWaitTime
+	consumerRequestTagEmptyBatches
+	consumerRequestTagPrefetch
+	consumerRequestTagManualCredit
+	consumerRequestTagGroup
+	consumerRequestTagConsumerId
+)
+
 func (r *ConsumerRequest) MarshalBinary() (data []byte, err error) {
-	return json.Marshal(r)
+	var e envelope
+	e.putString(consumerRequestTagQueueName, r.QueueName)
+	e.putUint(consumerRequestTagBatchSize, uint64(r.BatchSize))
+	e.putInt(consumerRequestTagWaitTime, int64(r.WaitTime))
+	if r.EmptyBatches {
+		e.putUint(consumerRequestTagEmptyBatches, 1)
+	}
+	e.putUint(consumerRequestTagPrefetch, uint64(r.Prefetch))
+	if r.ManualCredit {
+		e.putUint(consumerRequestTagManualCredit, 1)
+	}
+	e.putString(consumerRequestTagGroup, r.Group)
+	e.putString(consumerRequestTagConsumerId, r.ConsumerId)
+	return e.bytes(nil), nil
 }
 
 func (r *ConsumerRequest) UnmarshalBinary(bytes []byte) error {
-	err := json.Unmarshal(bytes, r)
-	if err != nil {
-		return err
+	_, err := readEnvelope(bytes, func(tag byte, value []byte) error {
+		switch tag {
+		case consumerRequestTagQueueName:
+			r.QueueName = string(value)
+		case consumerRequestTagBatchSize:
+			batchSize, err := readUint(value)
+			r.BatchSize = int(batchSize)
+			return err
+		case consumerRequestTagWaitTime:
+			waitTime, err := readInt(value)
+			r.WaitTime = time.Duration(waitTime)
+			return err
+		case consumerRequestTagEmptyBatches:
+			emptyBatches, err := readUint(value)
+			r.EmptyBatches = emptyBatches == 1
+			return err
+		case consumerRequestTagPrefetch:
+			prefetch, err := readUint(value)
+			r.Prefetch = int(prefetch)
+			return err
+		case consumerRequestTagManualCredit:
+			manualCredit, err := readUint(value)
+			r.ManualCredit = manualCredit == 1
+			return err
+		case consumerRequestTagGroup:
+			r.Group = string(value)
+		case consumerRequestTagConsumerId:
+			r.ConsumerId = string(value)
+		}
+		return nil
+	})
+	return err
+}
+
+// Credit is how many more messages a consumer can take, sent with CREDIT
+type Credit struct {
+	Count int
+}
+
+const (
+	creditTagCount byte = iota + 1
+)
+
+func (c *Credit) MarshalBinary() (data []byte, err error) {
+	var e envelope
+	e.putUint(creditTagCount, uint64(c.Count))
+	return e.bytes(nil), nil
+}
+
+func (c *Credit) UnmarshalBinary(bytes []byte) error {
+	_, err := readEnvelope(bytes, func(tag byte, value []byte) error {
+		switch tag {
+		case creditTagCount:
+			count, err := readUint(value)
+			c.Count = int(count)
+			return err
+		}
+		return nil
+	})
+	return err
+}
+
+// Revocation lists partitions a consumer is losing, sent with REVOKE. The
+// consumer answers with REVOKED once it is done with what it received from
+// them, only then does the server give them to another consumer
+type Revocation struct {
+	Partitions []int
+}
+
+const (
+	revocationTagPartition byte = iota + 1
+)
+
+func (r *Revocation) MarshalBinary() (data []byte, err error) {
+	var e envelope
+	for _, partition := range r.Partitions {
+		e.putUint(revocationTagPartition, uint64(partition))
 	}
-	return nil
+	return e.bytes(nil), nil
+}
+
+func (r *Revocation) UnmarshalBinary(bytes []byte) error {
+	_, err := readEnvelope(bytes, func(tag byte, value []byte) error {
+		switch tag {
+		case revocationTagPartition:
+			partition, err := readUint(value)
+			r.Partitions = append(r.Partitions, int(partition))
+			return err
+		}
+		return nil
+	})
+	return err
 }
 
 type ConsumerAck struct {
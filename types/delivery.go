@@ -0,0 +1,125 @@
+package types
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// the group a consumer joins when it doesn't name one
+const DEFAULT_CONSUMER_GROUP = "default"
+
+// ConsumerGroup is a set of consumers sharing the partitions of a queue, every
+// group receives every message of the queue
+type ConsumerGroup struct {
+	QueueName string `gorm:"primaryKey"`
+	Name      string `gorm:"primaryKey"`
+	CreatedAt time.Time
+	LastSeen  time.Time // the last time it had a consumer, it expires when that was too long ago
+}
+
+// Delivery is the state of a message in one consumer group, a message is gone
+// once every group of its queue acked it
+type Delivery struct {
+	MessageID    uint   `gorm:"primaryKey"`
+	GroupName    string `gorm:"primaryKey"`
+	QueueName    string `gorm:"index"`
+	Consumer     string // the consumer of the group holding the lease
+	Connection   int    // the connection the consumer holds the lease on
+	Receipt      string `gorm:"index"` // acks the message, a new one for every lease
+	LockDateTime time.Time
+	Acked        bool
+	Attempts     int       // how many times the group was sent the message
+	History      []Attempt `gorm:"serializer:json"`
+}
+
+// Attempt is one delivery of a message to a consumer of a group
+type Attempt struct {
+	Consumer    string    `json:"consumer"`
+	DeliveredAt time.Time `json:"deliveredAt"`
+	Reason      string    `json:"reason,omitempty"` // why the consumer handed it back, if it did
+}
+
+// DeadLetter is kept on a message that was moved to a dead-letter queue after
+// a group failed to process it or it expired, redriving it puts it back in
+// QueueName
+type DeadLetter struct {
+	QueueName string    `json:"queueName"`
+	Group     string    `json:"group,omitempty"` // none when it expired
+	MessageID uint      `json:"messageId"`       // the message in QueueName it was copied from
+	Reason    string    `json:"reason"`
+	Attempts  []Attempt `json:"attempts"`
+}
+
+// Redrive moves messages from a dead-letter queue back to the queues they
+// came from, the ones with MessageIds or when there are none up to Limit of
+// them, all of them when Limit is 0
+type Redrive struct {
+	QueueName  string
+	MessageIds []uint
+	Limit      int
+}
+
+const (
+	redriveTagQueueName byte = iota + 1
+	redriveTagMessageId
+	redriveTagLimit
+)
+
+func (r *Redrive) MarshalBinary() (data []byte, err error) {
+	var e envelope
+	e.putString(redriveTagQueueName, r.QueueName)
+	for _, id := range r.MessageIds {
+		e.put(redriveTagMessageId, binary.AppendUvarint(nil, uint64(id)))
+	}
+	e.putUint(redriveTagLimit, uint64(r.Limit))
+	return e.bytes(nil), nil
+}
+
+func (r *Redrive) UnmarshalBinary(bytes []byte) error {
+	_, err := readEnvelope(bytes, func(tag byte, value []byte) error {
+		switch tag {
+		case redriveTagQueueName:
+			r.QueueName = string(value)
+		case redriveTagMessageId:
+			id, err := readUint(value)
+			if err != nil {
+				return err
+			}
+			r.MessageIds = append(r.MessageIds, uint(id))
+		case redriveTagLimit:
+			limit, err := readUint(value)
+			r.Limit = int(limit)
+			return err
+		}
+		return nil
+	})
+	return err
+}
+
+// RedriveResult is the answer to a REDRIVE
+type RedriveResult struct {
+	Count int // how many messages were moved back
+}
+
+const (
+	redriveResultTagCount byte = iota + 1
+)
+
+func (r *RedriveResult) MarshalBinary() (data []byte, err error) {
+	var e envelope
+	e.putUint(redriveResultTagCount, uint64(r.Count))
+	return e.bytes(nil), nil
+}
+
+func (r *RedriveResult) UnmarshalBinary(bytes []byte) error {
+	_, err := readEnvelope(bytes, func(tag byte, value []byte) error {
+		switch tag {
+		case redriveResultTagCount:
+			count, err := readUint(value)
+			r.Count = int(count)
+			return err
+		}
+		return nil
+	})
+	return err
+}
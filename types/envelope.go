@@ -0,0 +1,126 @@
+package types
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The binary envelope is a list of fields followed by an optional raw body:
+//
+//	[tag][uvarint length][value] ... [tagEnd][body]
+//
+// every type picks its own tags, readers skip tags they don't know so new
+// fields can be added without breaking older clients. Tags must never be reused.
+const tagEnd byte = 0
+
+var ENVELOPE_ERROR = errors.New("malformed envelope")
+
+type envelope struct {
+	buf []byte
+}
+
+func (e *envelope) put(tag byte, value []byte) {
+	e.buf = append(e.buf, tag)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(value)))
+	e.buf = append(e.buf, value...)
+}
+
+func (e *envelope) putString(tag byte, value string) {
+	if value != "" {
+		e.put(tag, []byte(value))
+	}
+}
+
+func (e *envelope) putUint(tag byte, value uint64) {
+	if value != 0 {
+		e.put(tag, binary.AppendUvarint(nil, value))
+	}
+}
+
+func (e *envelope) putInt(tag byte, value int64) {
+	if value != 0 {
+		e.put(tag, binary.AppendVarint(nil, value))
+	}
+}
+
+func (e *envelope) putTime(tag byte, value time.Time) {
+	if !value.IsZero() {
+		e.putInt(tag, value.UnixNano())
+	}
+}
+
+// putPair writes a key value pair, used for maps like the message headers
+func (e *envelope) putPair(tag byte, key string, value string) {
+	pair := binary.AppendUvarint(nil, uint64(len(key)))
+	pair = append(pair, key...)
+	pair = append(pair, value...)
+	e.put(tag, pair)
+}
+
+// bytes ends the envelope and appends the body
+func (e *envelope) bytes(body []byte) []byte {
+	e.buf = append(e.buf, tagEnd)
+	return append(e.buf, body...)
+}
+
+// readEnvelope calls field for every field in data and returns the body
+func readEnvelope(data []byte, field func(tag byte, value []byte) error) ([]byte, error) {
+	for {
+		if len(data) == 0 {
+			return nil, fmt.Errorf("%w: missing end tag", ENVELOPE_ERROR)
+		}
+
+		tag := data[0]
+		data = data[1:]
+		if tag == tagEnd {
+			return data, nil
+		}
+
+		length, n := binary.Uvarint(data)
+		if n <= 0 || length > uint64(len(data)-n) {
+			return nil, fmt.Errorf("%w: bad length for tag %d", ENVELOPE_ERROR, tag)
+		}
+		data = data[n:]
+
+		err := field(tag, data[:length])
+		if err != nil {
+			return nil, err
+		}
+		data = data[length:]
+	}
+}
+
+func readUint(value []byte) (uint64, error) {
+	v, n := binary.Uvarint(value)
+	if n <= 0 {
+		return 0, fmt.Errorf("%w: bad uvarint", ENVELOPE_ERROR)
+	}
+	return v, nil
+}
+
+func readInt(value []byte) (int64, error) {
+	v, n := binary.Varint(value)
+	if n <= 0 {
+		return 0, fmt.Errorf("%w: bad varint", ENVELOPE_ERROR)
+	}
+	return v, nil
+}
+
+func readTime(value []byte) (time.Time, error) {
+	v, err := readInt(value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, v), nil
+}
+
+func readPair(value []byte) (string, string, error) {
+	length, n := binary.Uvarint(value)
+	if n <= 0 || length > uint64(len(value)-n) {
+		return "", "", fmt.Errorf("%w: bad pair", ENVELOPE_ERROR)
+	}
+	value = value[n:]
+	return string(value[:length]), string(value[length:]), nil
+}
@@ -0,0 +1,35 @@
+package types
+
+import (
+	"log/slog"
+	"time"
+)
+
+// Both sides of a connection that agreed on FEATURE_HEARTBEAT send a PING every
+// interval and answer every PING with a PONG, so each side hears from the
+// other at least once per its own interval. A side that hears nothing for
+// interval * missed heartbeats closes the connection.
+
+// Heartbeat sends a PING every interval until done is closed or a write fails
+func (c *Connection) Heartbeat(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			err := c.Write(c.NewCommand(PING, 0))
+			if err != nil {
+				slog.Debug("heartbeat stopped", "id", c.Id, "error", err)
+				return
+			}
+		}
+	}
+}
+
+// Pong answers a PING
+func (c *Connection) Pong(ping *TCPCommand) error {
+	return c.Write(c.Reply(ping, PONG))
+}
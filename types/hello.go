@@ -0,0 +1,83 @@
+package types
+
+import (
+	"fmt"
+	"slices"
+)
+
+// HELLO is the first frame a client sends, the server answers with a HELLO
+// holding the version and features both sides will use for the rest of the
+// connection. The payload is always a binary envelope so it can be read
+// whatever version the frame was written in.
+
+// versions a HELLO can agree on, lowest first. LEGACY_VERSION frames are only
+// read from clients that never say hello
+var SUPPORTED_VERSIONS = []byte{JSON_VERSION, BINARY_VERSION, VERSION}
+
+type Feature uint32
+
+const (
+	FEATURE_COMPRESSION Feature = 1 << iota
+	FEATURE_STREAMING
+	FEATURE_AUTH
+	FEATURE_HEARTBEAT
+	FEATURE_CHECKSUM
+)
+
+func (f Feature) Has(feature Feature) bool {
+	return f&feature == feature
+}
+
+type Hello struct {
+	Versions []byte
+	Features Feature
+}
+
+const (
+	helloTagVersions byte = iota + 1
+	helloTagFeatures
+)
+
+// Negotiate picks the highest version both sides support and the features
+// both sides have
+func (h *Hello) Negotiate(versions []byte, features Feature) (*Hello, error) {
+	for i := len(versions) - 1; i >= 0; i-- {
+		if slices.Contains(h.Versions, versions[i]) {
+			common := h.Features & features
+			// compression and checksums are marked in the flags, which older headers don't have
+			if versions[i] < FLAGS_VERSION {
+				common &^= FEATURE_COMPRESSION | FEATURE_CHECKSUM
+			}
+			return &Hello{
+				Versions: []byte{versions[i]},
+				Features: common,
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("no common protocol version in %v and %v", h.Versions, versions)
+}
+
+func (h *Hello) MarshalBinary() (bytes []byte, err error) {
+	var e envelope
+	e.put(helloTagVersions, h.Versions)
+	e.putUint(helloTagFeatures, uint64(h.Features))
+	return e.bytes(nil), nil
+}
+
+func (h *Hello) UnmarshalBinary(bytes []byte) error {
+	_, err := readEnvelope(bytes, func(tag byte, value []byte) error {
+		switch tag {
+		case helloTagVersions:
+			h.Versions = slices.Clone(value)
+		case helloTagFeatures:
+			features, err := readUint(value)
+			h.Features = Feature(features)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Hello#UnmarshalBinary %w", err)
+	}
+	return nil
+}
@@ -1,7 +1,9 @@
 package types
 
 import (
+	"encoding/binary"
 	"encoding/json"
+	"fmt"
 	"time"
 
 	"gorm.io/gorm"
@@ -9,55 +11,458 @@ import (
 
 type Message struct {
 	gorm.Model
-	QueueName     string         `gorm:"index:idx_messages_queue_partition_lock,priority:1" json:"queueName"`
-	Partition     int            `gorm:"index:idx_messages_queue_partition_lock,priority:2" json:"partition,omitempty"`
-	LockDateTime  time.Time      `gorm:"index:idx_messages_queue_partition_lock,priority:3" json:"lockDateTime,omitempty"`
-	DeletedAt     gorm.DeletedAt `gorm:"index:idx_messages_queue_partition_lock,priority:4" json:"deletedAt,omitempty"`
-	FileExtension string         `                                                          json:"fileExtention,omitempty"`
-	FileName      string         `                                                          json:"fileName,omitempty"`
-	Data          []byte         `                                                          json:"data"`
+	QueueName     string            `gorm:"index:idx_messages_queue_due,priority:1" json:"queueName"`
+	Partition     int               `gorm:"index:idx_messages_queue_due,priority:2" json:"partition,omitempty"`
+	DeletedAt     gorm.DeletedAt    `gorm:"index:idx_messages_queue_due,priority:3" json:"deletedAt,omitempty"`
+	DeliverAt     time.Time         `gorm:"index:idx_messages_queue_due,priority:4" json:"deliverAt,omitempty"`        // not delivered before then
+	Delay         time.Duration     `gorm:"-"                                             json:"delay,omitempty"`      // sets DeliverAt from when the server stores the message
+	ExpiresAt     *time.Time        `gorm:"index"                                         json:"expiresAt,omitempty"`  // never delivered from then on
+	TTL           time.Duration     `gorm:"-"                                             json:"ttl,omitempty"`        // sets ExpiresAt from when the message is due, the queue has a default
+	Priority      int               `                                                     json:"priority,omitempty"`   // higher ones are received first within a partition
+	MessageKey    string            `gorm:"index"                                         json:"messageKey,omitempty"` // publishing the same key again within the dedup window of the queue is dropped
+	PartitionKey  string            `                                                     json:"partitionKey,omitempty"`
+	Headers       map[string]string `gorm:"serializer:json"                               json:"headers,omitempty"`
+	FileExtension string            `                                                     json:"fileExtention,omitempty"`
+	FileName      string            `                                                     json:"fileName,omitempty"`
+	Streamed      bool              `                                                     json:"streamed,omitempty"`
+	Size          int64             `                                                     json:"size,omitempty"`
+	BlobName      string            `                                                     json:"-"`
+	Compression   Codec             `                                                     json:"compression,omitempty"`
+	Receipt       string            `gorm:"-"                                             json:"receipt,omitempty"`
+	Deliveries    int               `gorm:"-"                                             json:"deliveries,omitempty"` // how many times the group of the consumer was sent it, this one included
+	DeadLetter    *DeadLetter       `gorm:"serializer:json"                               json:"deadLetter,omitempty"`
+	Data          []byte            `                                                     json:"data"`
 }
 
+// binary envelope tags for a Message, the Data is the body of the envelope
+const (
+	messageTagId byte = iota + 1
+	messageTagQueueName
+	messageTagPartitionKey
+	messageTagPartition
+	messageTagHeader
+	messageTagFileName
+	messageTagFileExtension
+	messageTagCreatedAt
+	messageTagStreamed
+	messageTagSize
+	messageTagCompression
+	messageTagReceipt
+	messageTagDeliveries
+	messageTagDeadLetter
+	messageTagDeliverAt
+	messageTagDelay
+	messageTagExpiresAt
+	messageTagTTL
+	messageTagPriority
+	messageTagMessageKey
+)
+
 func (m *Message) MarshalBinary() (bytes []byte, err error) {
-	return json.Marshal(m)
+	var e envelope
+	e.putUint(messageTagId, uint64(m.ID))
+	e.putString(messageTagQueueName, m.QueueName)
+	e.putString(messageTagPartitionKey, m.PartitionKey)
+	e.putUint(messageTagPartition, uint64(m.Partition))
+	for key, value := range m.Headers {
+		e.putPair(messageTagHeader, key, value)
+	}
+	e.putString(messageTagFileName, m.FileName)
+	e.putString(messageTagFileExtension, m.FileExtension)
+	e.putTime(messageTagCreatedAt, m.CreatedAt)
+	if m.Streamed {
+		e.putUint(messageTagStreamed, 1)
+	}
+	e.putInt(messageTagSize, m.Size)
+	e.putUint(messageTagCompression, uint64(m.Compression))
+	e.putString(messageTagReceipt, m.Receipt)
+	e.putUint(messageTagDeliveries, uint64(m.Deliveries))
+	e.putTime(messageTagDeliverAt, m.DeliverAt)
+	e.putInt(messageTagDelay, int64(m.Delay))
+	if m.ExpiresAt != nil {
+		e.putTime(messageTagExpiresAt, *m.ExpiresAt)
+	}
+	e.putInt(messageTagTTL, int64(m.TTL))
+	e.putInt(messageTagPriority, int64(m.Priority))
+	e.putString(messageTagMessageKey, m.MessageKey)
+	if m.DeadLetter != nil {
+		deadLetter, err := json.Marshal(m.DeadLetter)
+		if err != nil {
+			return nil, err
+		}
+		e.put(messageTagDeadLetter, deadLetter)
+	}
+	return e.bytes(m.Data), nil
 }
 
 func (m *Message) UnmarshalBinary(bytes []byte) error {
-	err := json.Unmarshal(bytes, m)
+	body, err := readEnvelope(bytes, func(tag byte, value []byte) error {
+		switch tag {
+		case messageTagId:
+			id, err := readUint(value)
+			m.ID = uint(id)
+			return err
+		case messageTagQueueName:
+			m.QueueName = string(value)
+		case messageTagPartitionKey:
+			m.PartitionKey = string(value)
+		case messageTagPartition:
+			partition, err := readUint(value)
+			m.Partition = int(partition)
+			return err
+		case messageTagHeader:
+			key, val, err := readPair(value)
+			if err != nil {
+				return err
+			}
+			if m.Headers == nil {
+				m.Headers = make(map[string]string)
+			}
+			m.Headers[key] = val
+		case messageTagFileName:
+			m.FileName = string(value)
+		case messageTagFileExtension:
+			m.FileExtension = string(value)
+		case messageTagCreatedAt:
+			createdAt, err := readTime(value)
+			m.CreatedAt = createdAt
+			return err
+		case messageTagStreamed:
+			streamed, err := readUint(value)
+			m.Streamed = streamed == 1
+			return err
+		case messageTagSize:
+			size, err := readInt(value)
+			m.Size = size
+			return err
+		case messageTagCompression:
+			compression, err := readUint(value)
+			m.Compression = Codec(compression)
+			return err
+		case messageTagReceipt:
+			m.Receipt = string(value)
+		case messageTagDeliveries:
+			deliveries, err := readUint(value)
+			m.Deliveries = int(deliveries)
+			return err
+		case messageTagDeadLetter:
+			m.DeadLetter = &DeadLetter{}
+			return json.Unmarshal(value, m.DeadLetter)
+		case messageTagDeliverAt:
+			deliverAt, err := readTime(value)
+			m.DeliverAt = deliverAt
+			return err
+		case messageTagDelay:
+			delay, err := readInt(value)
+			m.Delay = time.Duration(delay)
+			return err
+		case messageTagExpiresAt:
+			expiresAt, err := readTime(value)
+			m.ExpiresAt = &expiresAt
+			return err
+		case messageTagTTL:
+			ttl, err := readInt(value)
+			m.TTL = time.Duration(ttl)
+			return err
+		case messageTagPriority:
+			priority, err := readInt(value)
+			m.Priority = int(priority)
+			return err
+		case messageTagMessageKey:
+			m.MessageKey = string(value)
+		}
+		return nil
+	})
 	if err != nil {
-		return err
+		return fmt.Errorf("Message#UnmarshalBinary %w", err)
 	}
+
+	m.Data = body
 	return nil
 }
 
+// Decompress replaces a compressed body with the original
+func (m *Message) Decompress() error {
+	if m.Compression == CODEC_NONE {
+		return nil
+	}
+
+	data, err := Decompress(m.Compression, m.Data)
+	if err != nil {
+		return fmt.Errorf("error decompressing message %d: %w", m.ID, err)
+	}
+	m.Data = data
+	m.Compression = CODEC_NONE
+	return nil
+}
+
+// PublishResult is the answer to a PUBLISH, or the CHUNK_END of a stream. A
+// duplicate wasn't stored, MessageId is the message published first
+type PublishResult struct {
+	MessageId uint
+	Duplicate bool
+
+	// only in the results of a PUBLISH_BATCH, why the message wasn't stored
+	Status Status
+	Error  string
+}
+
+const (
+	publishResultTagMessageId byte = iota + 1
+	publishResultTagDuplicate
+	publishResultTagStatus
+	publishResultTagError
+)
+
+// Err returns nil when the message was stored or was a duplicate, otherwise a
+// *ResponseError
+func (p *PublishResult) Err() error {
+	if p.Status == STATUS_OK {
+		return nil
+	}
+	return &ResponseError{Status: p.Status, Message: p.Error}
+}
+
+func (p *PublishResult) MarshalBinary() (bytes []byte, err error) {
+	var e envelope
+	e.putUint(publishResultTagMessageId, uint64(p.MessageId))
+	if p.Duplicate {
+		e.putUint(publishResultTagDuplicate, 1)
+	}
+	e.putUint(publishResultTagStatus, uint64(p.Status))
+	e.putString(publishResultTagError, p.Error)
+	return e.bytes(nil), nil
+}
+
+func (p *PublishResult) UnmarshalBinary(bytes []byte) error {
+	_, err := readEnvelope(bytes, func(tag byte, value []byte) error {
+		switch tag {
+		case publishResultTagMessageId:
+			id, err := readUint(value)
+			p.MessageId = uint(id)
+			return err
+		case publishResultTagDuplicate:
+			duplicate, err := readUint(value)
+			p.Duplicate = duplicate == 1
+			return err
+		case publishResultTagStatus:
+			status, err := readUint(value)
+			p.Status = Status(status)
+			return err
+		case publishResultTagError:
+			p.Error = string(value)
+		}
+		return nil
+	})
+	return err
+}
+
+// PublishBatchResult is the answer to a PUBLISH_BATCH, a result for every
+// message of the batch in the same order
+type PublishBatchResult struct {
+	Results []PublishResult
+}
+
+const publishBatchResultTagResult byte = 1
+
+func (p *PublishBatchResult) MarshalBinary() (bytes []byte, err error) {
+	var e envelope
+	for i := range p.Results {
+		result, err := p.Results[i].MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		e.put(publishBatchResultTagResult, result)
+	}
+	return e.bytes(nil), nil
+}
+
+func (p *PublishBatchResult) UnmarshalBinary(bytes []byte) error {
+	_, err := readEnvelope(bytes, func(tag byte, value []byte) error {
+		if tag == publishBatchResultTagResult {
+			var result PublishResult
+			err := result.UnmarshalBinary(value)
+			if err != nil {
+				return err
+			}
+			p.Results = append(p.Results, result)
+		}
+		return nil
+	})
+	return err
+}
+
 type MessageBatch struct {
 	Messages []Message
+
+	// set by the client instead of Messages when the consumer is losing
+	// partitions, it should finish with what it received from them before it
+	// receives again. Not sent over the wire
+	Revoked []int
 }
 
+const messageBatchTagMessage byte = 1
+
 func (m *MessageBatch) MarshalBinary() (bytes []byte, err error) {
-	return json.Marshal(m)
+	var e envelope
+	for i := range m.Messages {
+		msg, err := m.Messages[i].MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		e.put(messageBatchTagMessage, msg)
+	}
+	return e.bytes(nil), nil
 }
 
 func (m *MessageBatch) UnmarshalBinary(bytes []byte) error {
-	err := json.Unmarshal(bytes, m)
-	if err != nil {
-		return err
-	}
-	return nil
+	_, err := readEnvelope(bytes, func(tag byte, value []byte) error {
+		if tag == messageBatchTagMessage {
+			var msg Message
+			err := msg.UnmarshalBinary(value)
+			if err != nil {
+				return err
+			}
+			m.Messages = append(m.Messages, msg)
+		}
+		return nil
+	})
+	return err
 }
 
+// AckMessages acks messages by the Receipt they were delivered with, only the
+// connection the message was delivered to can ack it, and only until its lock
+// runs out. MessageIds are only taken from clients on JSON_VERSION or older,
+// which predate receipts. An id can't tell one lease of a message from the
+// next, so it acks whatever lease the connection holds on the message
 type AckMessages struct {
 	MessageIds []uint
+	Receipts   []string
 }
 
+const (
+	ackMessagesTagMessageId byte = iota + 1
+	ackMessagesTagReceipt
+)
+
 func (a *AckMessages) MarshalBinary() (bytes []byte, err error) {
-	return json.Marshal(a)
+	var e envelope
+	for _, id := range a.MessageIds {
+		e.put(ackMessagesTagMessageId, binary.AppendUvarint(nil, uint64(id)))
+	}
+	for _, receipt := range a.Receipts {
+		e.put(ackMessagesTagReceipt, []byte(receipt))
+	}
+	return e.bytes(nil), nil
 }
 
 func (a *AckMessages) UnmarshalBinary(bytes []byte) error {
-	err := json.Unmarshal(bytes, a)
-	if err != nil {
-		return err
+	_, err := readEnvelope(bytes, func(tag byte, value []byte) error {
+		switch tag {
+		case ackMessagesTagMessageId:
+			id, err := readUint(value)
+			if err != nil {
+				return err
+			}
+			a.MessageIds = append(a.MessageIds, uint(id))
+		case ackMessagesTagReceipt:
+			a.Receipts = append(a.Receipts, string(value))
+		}
+		return nil
+	})
+	return err
+}
+
+// NackMessages hands messages back by their Receipt, or their id like
+// AckMessages, they are delivered again once the Delay is over. The same messages can be handed back as acked.
+// The Reason is kept with the attempt for the dead-letter queue
+type NackMessages struct {
+	MessageIds []uint
+	Receipts   []string
+	Delay      time.Duration
+	Reason     string
+}
+
+const (
+	nackMessagesTagMessageId byte = iota + 1
+	nackMessagesTagReceipt
+	nackMessagesTagDelay
+	nackMessagesTagReason
+)
+
+func (n *NackMessages) MarshalBinary() (bytes []byte, err error) {
+	var e envelope
+	for _, id := range n.MessageIds {
+		e.put(nackMessagesTagMessageId, binary.AppendUvarint(nil, uint64(id)))
 	}
-	return nil
+	for _, receipt := range n.Receipts {
+		e.put(nackMessagesTagReceipt, []byte(receipt))
+	}
+	e.putInt(nackMessagesTagDelay, int64(n.Delay))
+	e.putString(nackMessagesTagReason, n.Reason)
+	return e.bytes(nil), nil
+}
+
+func (n *NackMessages) UnmarshalBinary(bytes []byte) error {
+	_, err := readEnvelope(bytes, func(tag byte, value []byte) error {
+		switch tag {
+		case nackMessagesTagMessageId:
+			id, err := readUint(value)
+			if err != nil {
+				return err
+			}
+			n.MessageIds = append(n.MessageIds, uint(id))
+		case nackMessagesTagReceipt:
+			n.Receipts = append(n.Receipts, string(value))
+		case nackMessagesTagDelay:
+			delay, err := readInt(value)
+			n.Delay = time.Duration(delay)
+			return err
+		case nackMessagesTagReason:
+			n.Reason = string(value)
+		}
+		return nil
+	})
+	return err
+}
+
+// AckResult is the answer to an ACK or NACK, it lists the ones that were
+// rejected because the message wasn't delivered to the connection, was already
+// acked or its lock ran out
+type AckResult struct {
+	RejectedIds      []uint
+	RejectedReceipts []string
+}
+
+const (
+	ackResultTagRejectedId byte = iota + 1
+	ackResultTagRejectedReceipt
+)
+
+func (a *AckResult) MarshalBinary() (bytes []byte, err error) {
+	var e envelope
+	for _, id := range a.RejectedIds {
+		e.put(ackResultTagRejectedId, binary.AppendUvarint(nil, uint64(id)))
+	}
+	for _, receipt := range a.RejectedReceipts {
+		e.put(ackResultTagRejectedReceipt, []byte(receipt))
+	}
+	return e.bytes(nil), nil
+}
+
+func (a *AckResult) UnmarshalBinary(bytes []byte) error {
+	_, err := readEnvelope(bytes, func(tag byte, value []byte) error {
+		switch tag {
+		case ackResultTagRejectedId:
+			id, err := readUint(value)
+			if err != nil {
+				return err
+			}
+			a.RejectedIds = append(a.RejectedIds, uint(id))
+		case ackResultTagRejectedReceipt:
+			a.RejectedReceipts = append(a.RejectedReceipts, string(value))
+		}
+		return nil
+	})
+	return err
 }
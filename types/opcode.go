@@ -0,0 +1,68 @@
+package types
+
+import "fmt"
+
+// Opcode is the command of a frame, shared by the client and the server
+type Opcode byte
+
+const (
+	DELIVER        Opcode = 0 // a MessageBatch pushed to a consumer
+	CREATE         Opcode = 1
+	PUBLISH        Opcode = 2
+	RECEIVE        Opcode = 3
+	ACK            Opcode = 4
+	_              Opcode = 5 // was OUST, a disconnect is TCPCommandWrapper.Disconnected now
+	RESPONSE       Opcode = 6
+	PUBLISH_STREAM Opcode = 7
+	CHUNK          Opcode = 8
+	CHUNK_END      Opcode = 9
+	FETCH          Opcode = 10
+	HELLO          Opcode = 11
+	PING           Opcode = 12
+	PONG           Opcode = 13
+	GOAWAY         Opcode = 14 // the server is shutting down and won't deliver to the consumer again
+	CREDIT         Opcode = 15 // a consumer lets the server send more messages
+	ALTER          Opcode = 16 // change the partitions of a queue
+	REVOKE         Opcode = 17 // partitions are moving away from a consumer once it is done with them
+	REVOKED        Opcode = 18 // the consumer is done with the partitions it was revoked
+	NACK           Opcode = 19 // a consumer hands messages back to be delivered again
+	REDRIVE        Opcode = 20 // move messages from a dead-letter queue back where they came from
+	PUBLISH_BATCH  Opcode = 21 // store a MessageBatch at once, the messages can go to different queues
+	FETCH_CREDIT   Opcode = 22 // the client made room for more chunks of a body it is fetching
+)
+
+// opcodes from here up are free for commands registered by applications
+const CUSTOM_OPCODE Opcode = 128
+
+var opcodeNames = map[Opcode]string{
+	DELIVER:        "DELIVER",
+	CREATE:         "CREATE",
+	PUBLISH:        "PUBLISH",
+	RECEIVE:        "RECEIVE",
+	ACK:            "ACK",
+	RESPONSE:       "RESPONSE",
+	PUBLISH_STREAM: "PUBLISH_STREAM",
+	CHUNK:          "CHUNK",
+	CHUNK_END:      "CHUNK_END",
+	FETCH:          "FETCH",
+	HELLO:          "HELLO",
+	PING:           "PING",
+	PONG:           "PONG",
+	GOAWAY:         "GOAWAY",
+	CREDIT:         "CREDIT",
+	ALTER:          "ALTER",
+	REVOKE:         "REVOKE",
+	REVOKED:        "REVOKED",
+	NACK:           "NACK",
+	REDRIVE:        "REDRIVE",
+	PUBLISH_BATCH:  "PUBLISH_BATCH",
+	FETCH_CREDIT:   "FETCH_CREDIT",
+}
+
+func (o Opcode) String() string {
+	name, ok := opcodeNames[o]
+	if !ok {
+		return fmt.Sprintf("OPCODE(%d)", byte(o))
+	}
+	return name
+}
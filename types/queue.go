@@ -1,25 +1,104 @@
 package types
 
 import (
-	"encoding/json"
+	"fmt"
+	"time"
 
 	"gorm.io/gorm"
 )
 
+// ExpiryPolicy is what happens to the messages of a queue that expired before
+// every group acked them
+type ExpiryPolicy byte
+
+const (
+	EXPIRY_DISCARD     ExpiryPolicy = iota + 1 // removed, the default
+	EXPIRY_DEAD_LETTER                         // moved to the DeadLetterQueue
+)
+
+func (p ExpiryPolicy) String() string {
+	switch p {
+	case 0, EXPIRY_DISCARD:
+		return "discard"
+	case EXPIRY_DEAD_LETTER:
+		return "dead-letter"
+	default:
+		return fmt.Sprintf("expiryPolicy(%d)", byte(p))
+	}
+}
+
 type Queue struct {
 	gorm.Model
 	Name          string `gorm:"index" json:"name"`
 	MaxPartitions int    `json:"maxPartitions"`
+
+	// a group that was sent a message MaxDeliveries times without acking it
+	// gives up on it, it is moved to the DeadLetterQueue or dropped when there
+	// is none. No limit when 0
+	MaxDeliveries   int    `json:"maxDeliveries,omitempty"`
+	DeadLetterQueue string `json:"deadLetterQueue,omitempty"`
+
+	// messages published without a TTL of their own get this one, they don't
+	// expire when 0
+	DefaultTTL   time.Duration `json:"defaultTTL,omitempty"`
+	ExpiryPolicy ExpiryPolicy  `json:"expiryPolicy,omitempty"`
+
+	// a message published with the MessageKey of one published this long ago
+	// or less is dropped, the server has a default when 0
+	DedupWindow time.Duration `json:"dedupWindow,omitempty"`
 }
 
+const (
+	queueTagName byte = iota + 1
+	queueTagMaxPartitions
+	queueTagMaxDeliveries
+	queueTagDeadLetterQueue
+	queueTagDefaultTTL
+	queueTagExpiryPolicy
+	queueTagDedupWindow
+)
+
 func (m *Queue) MarshalBinary() (bytes []byte, err error) {
-	return json.Marshal(m)
+	var e envelope
+	e.putString(queueTagName, m.Name)
+	e.putUint(queueTagMaxPartitions, uint64(m.MaxPartitions))
+	e.putUint(queueTagMaxDeliveries, uint64(m.MaxDeliveries))
+	e.putString(queueTagDeadLetterQueue, m.DeadLetterQueue)
+	e.putInt(queueTagDefaultTTL, int64(m.DefaultTTL))
+	e.putUint(queueTagExpiryPolicy, uint64(m.ExpiryPolicy))
+	e.putInt(queueTagDedupWindow, int64(m.DedupWindow))
+	return e.bytes(nil), nil
 }
 
 func (m *Queue) UnmarshalBinary(bytes []byte) error {
-	err := json.Unmarshal(bytes, m)
-	if err != nil {
-		return err
-	}
-	return nil
+	_, err := readEnvelope(bytes, func(tag byte, value []byte) error {
+		switch tag {
+		case queueTagName:
+			m.Name = string(value)
+		case queueTagMaxPartitions:
+			maxPartitions, err := readUint(value)
+			m.MaxPartitions = int(maxPartitions)
+			return err
+		case queueTagMaxDeliveries:
+			maxDeliveries, err := readUint(value)
+			m.MaxDeliveries = int(maxDeliveries)
+			return err
+		case queueTagDeadLetterQueue:
+			m.DeadLetterQueue = string(value)
+		case queueTagDefaultTTL:
+			ttl, err := readInt(value)
+			m.DefaultTTL = time.Duration(ttl)
+			return err
+		case queueTagExpiryPolicy:
+			policy, err := readUint(value)
+			m.ExpiryPolicy = ExpiryPolicy(policy)
+			return err
+		case queueTagDedupWindow:
+			window, err := readInt(value)
+			m.DedupWindow = time.Duration(window)
+			return err
+		}
+		return nil
+	})
+	return err
 }
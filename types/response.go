@@ -0,0 +1,122 @@
+package types
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+)
+
+// the server answers every request with a RESPONSE frame, the RequestId of the
+// frame is the RequestId of the request it answers
+
+type Status byte
+
+const (
+	STATUS_OK Status = iota
+	STATUS_BAD_REQUEST
+	STATUS_ERROR
+	STATUS_UNKNOWN_COMMAND
+	STATUS_PROTOCOL_ERROR
+)
+
+func (s Status) String() string {
+	switch s {
+	case STATUS_OK:
+		return "OK"
+	case STATUS_BAD_REQUEST:
+		return "BAD_REQUEST"
+	case STATUS_ERROR:
+		return "ERROR"
+	case STATUS_UNKNOWN_COMMAND:
+		return "UNKNOWN_COMMAND"
+	case STATUS_PROTOCOL_ERROR:
+		return "PROTOCOL_ERROR"
+	default:
+		return fmt.Sprintf("STATUS(%d)", byte(s))
+	}
+}
+
+// returned by a handler when the request could not be decoded
+var BAD_REQUEST_ERROR = errors.New("bad request")
+
+// returned for requests that arrive while the server is shutting down
+var SHUTDOWN_ERROR = errors.New("binq is shutting down")
+
+// returned when nothing is registered for the opcode of a request
+var UNKNOWN_COMMAND_ERROR = errors.New("unknown command")
+
+type Response struct {
+	Status Status `json:"status"`
+	Error  string `json:"error,omitempty"`
+	Data   []byte `json:"data,omitempty"` // the binary result of commands that have one, see Decode
+}
+
+func NewResponse(err error) *Response {
+	switch {
+	case err == nil:
+		return &Response{Status: STATUS_OK}
+	case errors.Is(err, BAD_REQUEST_ERROR):
+		return &Response{Status: STATUS_BAD_REQUEST, Error: err.Error()}
+	case errors.Is(err, UNKNOWN_COMMAND_ERROR):
+		return &Response{Status: STATUS_UNKNOWN_COMMAND, Error: err.Error()}
+	case errors.Is(err, PROTOCOL_ERROR):
+		return &Response{Status: STATUS_PROTOCOL_ERROR, Error: err.Error()}
+	default:
+		return &Response{Status: STATUS_ERROR, Error: err.Error()}
+	}
+}
+
+// Err returns nil when the request succeeded, otherwise a *ResponseError
+func (r *Response) Err() error {
+	if r.Status == STATUS_OK {
+		return nil
+	}
+	return &ResponseError{Status: r.Status, Message: r.Error}
+}
+
+const (
+	responseTagStatus byte = iota + 1
+	responseTagError
+)
+
+// Decode reads the result of the command into the payload
+func (r *Response) Decode(payload encoding.BinaryUnmarshaler) error {
+	return payload.UnmarshalBinary(r.Data)
+}
+
+func (r *Response) MarshalBinary() (data []byte, err error) {
+	var e envelope
+	e.putUint(responseTagStatus, uint64(r.Status))
+	e.putString(responseTagError, r.Error)
+	return e.bytes(r.Data), nil
+}
+
+func (r *Response) UnmarshalBinary(bytes []byte) error {
+	body, err := readEnvelope(bytes, func(tag byte, value []byte) error {
+		switch tag {
+		case responseTagStatus:
+			status, err := readUint(value)
+			r.Status = Status(status)
+			return err
+		case responseTagError:
+			r.Error = string(value)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(body) > 0 {
+		r.Data = body
+	}
+	return nil
+}
+
+type ResponseError struct {
+	Status  Status
+	Message string
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("binq %s: %s", e.Status, e.Message)
+}
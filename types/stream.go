@@ -0,0 +1,62 @@
+package types
+
+import "fmt"
+
+// Large bodies are sent as a stream of frames that share a RequestId:
+//
+//	PUBLISH_STREAM (message without a body) -> CHUNK ... -> CHUNK_END (Response)
+//	FETCH (message id) -> RESPONSE -> CHUNK ... -> CHUNK_END (Response)
+//
+// a fetched body is only sent as fast as it is read, the server sends at most
+// Window chunks ahead and the client hands back a FETCH_CREDIT for every chunk
+// it is done with.
+// the Response in CHUNK_END tells the other side whether the sender finished
+// the body or gave up on it part way through.
+
+// the size of the body carried by a single CHUNK frame
+const STREAM_CHUNK_SIZE = 1 << 20
+
+// FetchRequest asks for the body of a message leased to the connection, the
+// Receipt it was delivered with pins the lease. Window is how many chunks the
+// client has room for before it hands out FETCH_CREDIT
+type FetchRequest struct {
+	MessageId uint
+	Receipt   string
+	Window    int
+}
+
+const (
+	fetchRequestTagMessageId byte = iota + 1
+	fetchRequestTagReceipt
+	fetchRequestTagWindow
+)
+
+func (f *FetchRequest) MarshalBinary() (bytes []byte, err error) {
+	var e envelope
+	e.putUint(fetchRequestTagMessageId, uint64(f.MessageId))
+	e.putString(fetchRequestTagReceipt, f.Receipt)
+	e.putInt(fetchRequestTagWindow, int64(f.Window))
+	return e.bytes(nil), nil
+}
+
+func (f *FetchRequest) UnmarshalBinary(bytes []byte) error {
+	_, err := readEnvelope(bytes, func(tag byte, value []byte) error {
+		switch tag {
+		case fetchRequestTagMessageId:
+			id, err := readUint(value)
+			f.MessageId = uint(id)
+			return err
+		case fetchRequestTagReceipt:
+			f.Receipt = string(value)
+		case fetchRequestTagWindow:
+			window, err := readInt(value)
+			f.Window = int(window)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("FetchRequest#UnmarshalBinary %w", err)
+	}
+	return nil
+}
@@ -1,18 +1,72 @@
 package types
 
 import (
+	"encoding"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"slices"
 )
 
 var (
-	VERSION     byte = 0
-	HEADER_SIZE      = 6
+	VERSION        byte = 3 // written unless the connection agreed on something older
+	FLAGS_VERSION  byte = 3 // the header carries Flags
+	BINARY_VERSION byte = 2 // Data is a binary envelope
+	JSON_VERSION   byte = 1 // Data is json
+	LEGACY_VERSION byte = 0 // the first layout, Data is json and the header has no request id
+	HEADER_SIZE         = 11
+	LENGTH_OFFSET       = 7 // the length sits after the version, command, flags and request id
 )
 
 type TCPCommand struct {
-	Command byte
-	Data    []byte
+	Version   byte // layout of the header and Data, see Connection.NewCommand
+	Command   Opcode
+	Flags     byte   // only sent from FLAGS_VERSION, see FLAG_CODEC and FLAG_CHECKSUM
+	RequestId uint32 // correlates a request with the server's response
+	Data      []byte
+}
+
+// headerLayout returns the header size and length offset of a version, frames
+// before FLAGS_VERSION have no flags byte and LEGACY_VERSION frames have no
+// request id either
+func headerLayout(version byte) (int, int) {
+	switch {
+	case version == LEGACY_VERSION:
+		return HEADER_SIZE - 5, LENGTH_OFFSET - 5
+	case version < FLAGS_VERSION:
+		return HEADER_SIZE - 1, LENGTH_OFFSET - 1
+	}
+	return HEADER_SIZE, LENGTH_OFFSET
+}
+
+// readable reports whether frames of a version can be read, LEGACY_VERSION is
+// never agreed on in a HELLO but is still read from clients that never say one
+func readable(version byte) bool {
+	return version == LEGACY_VERSION || slices.Contains(SUPPORTED_VERSIONS, version)
+}
+
+// Codec is how Data was compressed on the wire, Connection.Next has already
+// decompressed it
+func (t *TCPCommand) Codec() Codec {
+	return Codec(t.Flags & FLAG_CODEC)
+}
+
+// EncodeData sets Data from the payload using the layout of the command's Version
+func (t *TCPCommand) EncodeData(payload encoding.BinaryMarshaler) (err error) {
+	if t.Version <= JSON_VERSION {
+		t.Data, err = json.Marshal(payload)
+	} else {
+		t.Data, err = payload.MarshalBinary()
+	}
+	return err
+}
+
+// DecodeData reads Data into the payload using the layout of the command's Version
+func (t *TCPCommand) DecodeData(payload encoding.BinaryUnmarshaler) error {
+	if t.Version <= JSON_VERSION {
+		return json.Unmarshal(t.Data, payload)
+	}
+	return payload.UnmarshalBinary(t.Data)
 }
 
 func (t *TCPCommand) MarshalBinary() (data []byte, err error) {
@@ -20,43 +74,93 @@ func (t *TCPCommand) MarshalBinary() (data []byte, err error) {
 	lengthData := make([]byte, 4)                  // make a byte array of size 2
 	binary.BigEndian.PutUint32(lengthData, length) // put the length in the lengthData byte array
 
+	version := t.Version
+	headerSize, _ := headerLayout(version)
+	if headerSize < HEADER_SIZE && t.Flags != 0 {
+		return nil, fmt.Errorf("flags need version %d, got %d", FLAGS_VERSION, version)
+	}
+
 	b := make(
 		[]byte,
 		0,
-		1+1+4+length,
-	) // make a byte array of size 0 and a capacity of the HEADER_SIZE + the length of data
-	b = append(b, VERSION)   // add the version to the byte array
-	b = append(b, t.Command) // append the Command
+		uint32(headerSize)+length,
+	) // make a byte array of size 0 and a capacity of the header size + the length of data
+	b = append(b, version)         // add the version to the byte array
+	b = append(b, byte(t.Command)) // append the Command
+	if headerSize == HEADER_SIZE {
+		b = append(b, t.Flags) // append the flags
+	}
+	if version != LEGACY_VERSION {
+		b = binary.BigEndian.AppendUint32(b, t.RequestId) // append the request id
+	}
 	b = append(
 		b,
 		lengthData...) // append the length of the data, since its 2 bytes it will spread them into the return byte array
-	return append(
+	b = append(
 		b,
-		t.Data...), nil // append the data itself into the byte array and a nil for the error
+		t.Data...) // append the data itself into the byte array
+	if t.Flags&FLAG_CHECKSUM != 0 {
+		b = binary.BigEndian.AppendUint32(b, checksum(b)) // append the checksum of everything before it
+	}
+	return b, nil
 }
 
+// UnmarshalBinary never trusts the header, anything malformed is a PROTOCOL_ERROR
 func (t *TCPCommand) UnmarshalBinary(bytes []byte) error {
-	if bytes[0] != VERSION { // if the first byte is not the correct version then return an error
-		return fmt.Errorf("version mismatch %d != %d", bytes[0], VERSION)
+	if len(bytes) == 0 {
+		return fmt.Errorf("%w: empty frame", PROTOCOL_ERROR)
+	}
+	if !readable(bytes[0]) { // if the first byte is not a known version then return an error
+		return fmt.Errorf("%w: version mismatch %d not in %v", PROTOCOL_ERROR, bytes[0], SUPPORTED_VERSIONS)
+	}
+
+	headerSize, lengthOffset := headerLayout(bytes[0])
+	if len(bytes) < headerSize {
+		return fmt.Errorf("%w: short header, got %d expected %d", PROTOCOL_ERROR, len(bytes), headerSize)
 	}
 
 	length := int(
-		binary.BigEndian.Uint32(bytes[2:]),
-	) // get the length at the second index, Uint16 --> 16 bits which is 2 bytes
-	end := HEADER_SIZE + length // calculate the end
+		binary.BigEndian.Uint32(bytes[lengthOffset:]),
+	) // get the length at the length offset, Uint32 --> 32 bits which is 4 bytes
+	end := headerSize + length // calculate the end
 
-	if len(bytes) < end {
+	command := Opcode(bytes[1])
+	flags := byte(0)
+	if headerSize == HEADER_SIZE {
+		flags = bytes[2]
+	}
+
+	trailer := 0
+	if flags&FLAG_CHECKSUM != 0 {
+		trailer = CHECKSUM_SIZE
+	}
+
+	if len(bytes) < end+trailer {
 		return fmt.Errorf(
-			"not enough data to parse packet: got %d expected %d",
+			"%w: not enough data to parse packet: got %d expected %d",
+			PROTOCOL_ERROR,
 			len(bytes),
-			HEADER_SIZE+length,
+			end+trailer,
 		)
 	}
 
-	command := bytes[1]
-	data := bytes[HEADER_SIZE:end]
+	if trailer != 0 {
+		expected := binary.BigEndian.Uint32(bytes[end:])
+		if actual := checksum(bytes[:end]); actual != expected {
+			return fmt.Errorf("%w: checksum mismatch %08x != %08x", PROTOCOL_ERROR, actual, expected)
+		}
+	}
+
+	requestId := uint32(0)
+	if bytes[0] != LEGACY_VERSION {
+		requestId = binary.BigEndian.Uint32(bytes[lengthOffset-4:])
+	}
+	data := bytes[headerSize:end]
 
+	t.Version = bytes[0]
 	t.Command = command
+	t.Flags = flags
+	t.RequestId = requestId
 	t.Data = data
 
 	return nil
@@ -65,4 +169,6 @@ func (t *TCPCommand) UnmarshalBinary(bytes []byte) error {
 type TCPCommandWrapper struct {
 	Conn    *Connection
 	Command *TCPCommand
+	// the connection is gone and Command is nil, sent once after its last command
+	Disconnected bool
 }
@@ -3,13 +3,14 @@ package utils
 import (
 	"crypto/md5"
 	"fmt"
+	"hash/fnv"
 	"math/rand/v2"
 	"net"
 )
 
 // Function to split a slice into batches
-func ChunkSlice(slice []uint, chunkSize int) [][]uint {
-	var chunks [][]uint
+func ChunkSlice[T any](slice []T, chunkSize int) [][]T {
+	var chunks [][]T
 	for i := 0; i < len(slice); i += chunkSize {
 		end := i + chunkSize
 		if end > len(slice) {
@@ -25,6 +26,13 @@ func RandRange(min, max int) int {
 	return rand.IntN(max+1-min) + min
 }
 
+// Return the partition between 1 and partitions a key always hashes to
+func KeyPartition(key string, partitions int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32()%uint32(partitions)) + 1
+}
+
 func GetConnectionHash(conn net.Conn) string {
 	localAddr := conn.LocalAddr().String()
 	remoteAddr := conn.RemoteAddr().String()